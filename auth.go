@@ -0,0 +1,300 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// AuthProvider finds the credentials for a registry. Some providers also
+// move the connection to a different URL, like ECR handing out the endpoint
+// together with the token.
+type AuthProvider interface {
+	// Name is how the provider is chosen with --src-auth or --dest-auth
+	Name() string
+	// Matches tells whether the provider handles a registry when no provider
+	// is chosen explicitly
+	Matches(url string) bool
+	Credentials(url string) (username, password, effectiveURL string, err error)
+}
+
+// authProviders lists the providers in the order they are tried. An explicit
+// --cred-helper wins over the providers picked by the registry host, and the
+// basic provider matches every registry, so it has to come last.
+func authProviders(username string, password string, credHelper string, deadline context.Context) []AuthProvider {
+	return []AuthProvider{
+		&credHelperAuthProvider{Username: username, Password: password, Helper: credHelper, Deadline: deadline},
+		&ecrAuthProvider{Username: username, Password: password},
+		&gcrAuthProvider{Username: username, Password: password},
+		&gitHubAuthProvider{Username: username, Password: password},
+		&basicAuthProvider{Username: username, Password: password},
+	}
+}
+
+func authProviderNames() []string {
+	names := []string{"auto"}
+	for _, provider := range authProviders("", "", "", nil) {
+		names = append(names, provider.Name())
+	}
+	return names
+}
+
+// selectAuthProvider returns the provider with the given name, or the first
+// one that matches the registry for "auto".
+func selectAuthProvider(name string, url string, username string, password string, credHelper string, deadline context.Context) (AuthProvider, error) {
+	for _, provider := range authProviders(username, password, credHelper, deadline) {
+		if name == provider.Name() || (name == "auto" || name == "") && provider.Matches(url) {
+			return provider, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown auth provider %s", name)
+}
+
+// basicAuthProvider uses the credentials given on the command line as they
+// are, or none at all.
+type basicAuthProvider struct {
+	Username string
+	Password string
+}
+
+func (p *basicAuthProvider) Name() string {
+	return "basic"
+}
+
+func (p *basicAuthProvider) Matches(url string) bool {
+	return true
+}
+
+func (p *basicAuthProvider) Credentials(url string) (string, string, string, error) {
+	return p.Username, p.Password, url, nil
+}
+
+var ecrURLPattern = regexp.MustCompile(`(?P<account_id>[0-9]{12})\.dkr\.ecr\.(?P<region>[\w\d-]+)\.amazonaws\.com`)
+
+// ecrAuthProvider exchanges the AWS credentials of the environment for an
+// ECR authorization token.
+type ecrAuthProvider struct {
+	Username string
+	Password string
+}
+
+func (p *ecrAuthProvider) Name() string {
+	return "ecr"
+}
+
+func (p *ecrAuthProvider) Matches(url string) bool {
+	return ecrURLPattern.MatchString(url) && p.Username == "" && p.Password == ""
+}
+
+func (p *ecrAuthProvider) Credentials(url string) (string, string, string, error) {
+	r2 := ecrURLPattern.FindAllStringSubmatch(url, -1)
+	if r2 == nil {
+		return "", "", "", &exitError{Code: exitUsage, Err: fmt.Errorf("%s is not an ECR registry URL", url)}
+	}
+
+	registryId := r2[0][1]
+	region := r2[0][2]
+
+	resp, err := ecrAuthorizationToken(region, registryId)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(*resp.AuthorizationData[0].AuthorizationToken)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Failed to decode base64 encoded authorization data for ECR registry %s. %v", registryId, err)
+	}
+
+	parts := strings.Split(string(decoded), ":")
+
+	return parts[0], parts[1], *resp.AuthorizationData[0].ProxyEndpoint, nil
+}
+
+// ecrAuthorizationToken asks ECR for a token, it is replaced in tests.
+var ecrAuthorizationToken = func(region string, registryId string) (*ecr.GetAuthorizationTokenOutput, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create new AWS SDK session. %v", err)
+	}
+	svc := ecr.New(sess)
+	params := &ecr.GetAuthorizationTokenInput{
+		RegistryIds: []*string{
+			aws.String(registryId), // Required
+		},
+	}
+
+	resp, err := svc.GetAuthorizationToken(params)
+	if err != nil {
+		return nil, &exitError{Code: exitAuth, Err: fmt.Errorf("Failed to get ECR authorization token for registry %s. %v", registryId, err)}
+	}
+	return resp, nil
+}
+
+const gcrUsername = "oauth2accesstoken"
+
+// gcrAuthProvider signs in to Google Container Registry and Artifact
+// Registry with an OAuth access token, like the one printed by
+// `gcloud auth print-access-token`, taken from GOOGLE_OAUTH_ACCESS_TOKEN.
+type gcrAuthProvider struct {
+	Username string
+	Password string
+}
+
+func (p *gcrAuthProvider) Name() string {
+	return "gcr"
+}
+
+func (p *gcrAuthProvider) Matches(url string) bool {
+	return isGoogleContainerRegistry(url) && p.Username == "" && p.Password == "" && os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN") != ""
+}
+
+func (p *gcrAuthProvider) Credentials(url string) (string, string, string, error) {
+	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" {
+		return "", "", "", &exitError{Code: exitAuth, Err: fmt.Errorf("GOOGLE_OAUTH_ACCESS_TOKEN is required to access %s", url)}
+	}
+	return gcrUsername, token, url, nil
+}
+
+func isGoogleContainerRegistry(registryURL string) bool {
+	parsed, err := neturl.Parse(registryURL)
+	if err != nil {
+		return false
+	}
+	return parsed.Host == "gcr.io" || strings.HasSuffix(parsed.Host, ".gcr.io") || strings.HasSuffix(parsed.Host, "-docker.pkg.dev")
+}
+
+const ghcrUsernamePlaceholder = "copy-docker-image"
+
+// gitHubAuthProvider signs in to ghcr.io, which exchanges a personal access
+// token for a bearer token. The username is not checked but has to be
+// present, so it falls back to a placeholder when only the token is known.
+type gitHubAuthProvider struct {
+	Username string
+	Password string
+}
+
+func (p *gitHubAuthProvider) Name() string {
+	return "ghcr"
+}
+
+func (p *gitHubAuthProvider) Matches(url string) bool {
+	return isGitHubContainerRegistry(url)
+}
+
+func (p *gitHubAuthProvider) Credentials(url string) (string, string, string, error) {
+	username := p.Username
+	password := p.Password
+	if password == "" {
+		password = os.Getenv("GITHUB_TOKEN")
+	}
+	if password != "" && username == "" {
+		username = ghcrUsernamePlaceholder
+	}
+	return username, password, url, nil
+}
+
+func isGitHubContainerRegistry(registryURL string) bool {
+	parsed, err := neturl.Parse(registryURL)
+	if err != nil {
+		return false
+	}
+	return parsed.Host == "ghcr.io"
+}
+
+const credHelperTimeout = 30 * time.Second
+
+// credHelperAuthProvider asks an external command for the credentials, so
+// secret stores this tool knows nothing about can be used. The command is
+// run with a get argument and the registry URL on stdin, and answers with
+// JSON holding a username and a password. Docker credential helpers answer
+// with a Secret instead of a password, which works too. The command is
+// killed once --deadline passes, if that comes before its own timeout.
+type credHelperAuthProvider struct {
+	Username string
+	Password string
+	Helper   string
+	Deadline context.Context
+}
+
+func (p *credHelperAuthProvider) Name() string {
+	return "cred-helper"
+}
+
+func (p *credHelperAuthProvider) Matches(url string) bool {
+	return p.Helper != "" && p.Username == "" && p.Password == ""
+}
+
+func (p *credHelperAuthProvider) Credentials(url string) (string, string, string, error) {
+	if p.Helper == "" {
+		return "", "", "", &exitError{Code: exitUsage, Err: fmt.Errorf("--cred-helper is required to access %s with a credential helper", url)}
+	}
+
+	parent := p.Deadline
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, credHelperTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Helper, "get")
+	cmd.Stdin = strings.NewReader(url)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if parent.Err() == context.DeadlineExceeded {
+		return "", "", "", &exitError{Code: exitDeadline, Err: fmt.Errorf("The --deadline passed while waiting for the credential helper %s for %s", p.Helper, url)}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", "", "", &exitError{Code: exitAuth, Err: fmt.Errorf("The credential helper %s did not answer for %s within %v", p.Helper, url, credHelperTimeout)}
+	}
+	if err != nil {
+		// stdout may hold a secret, only stderr is reported
+		message := strings.TrimSpace(stderr.String())
+		if message != "" {
+			err = fmt.Errorf("%v: %s", err, message)
+		}
+		return "", "", "", &exitError{Code: exitAuth, Err: fmt.Errorf("The credential helper %s failed for %s. %v", p.Helper, url, err)}
+	}
+
+	var credentials struct {
+		Username string
+		Password string
+		Secret   string
+	}
+	err = json.Unmarshal(stdout.Bytes(), &credentials)
+	if err != nil {
+		return "", "", "", &exitError{Code: exitAuth, Err: fmt.Errorf("The credential helper %s answered with invalid JSON for %s", p.Helper, url)}
+	}
+	if credentials.Password == "" {
+		credentials.Password = credentials.Secret
+	}
+	return credentials.Username, credentials.Password, url, nil
+}
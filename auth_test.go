@@ -0,0 +1,208 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestGitHubCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		env      string
+		expected [2]string
+	}{
+		{"token from the environment", "", "", "env-token", [2]string{ghcrUsernamePlaceholder, "env-token"}},
+		{"password wins over the environment", "octocat", "flag-token", "env-token", [2]string{"octocat", "flag-token"}},
+		{"empty username with a password", "", "flag-token", "", [2]string{ghcrUsernamePlaceholder, "flag-token"}},
+		{"no token at all", "", "", "", [2]string{"", ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GITHUB_TOKEN", test.env)
+			provider := &gitHubAuthProvider{Username: test.username, Password: test.password}
+			username, password, url, err := provider.Credentials("https://ghcr.io")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if [2]string{username, password} != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, [2]string{username, password})
+			}
+			if url != "https://ghcr.io" {
+				t.Errorf("Expected the URL to be kept, got %s", url)
+			}
+		})
+	}
+}
+
+func TestGitHubTokenScope(t *testing.T) {
+	fake := newFakeRegistry(t)
+	fake.Bearer = true
+	// ghcr.io ignores the username, the fake checks it to see the placeholder
+	fake.Username = ghcrUsernamePlaceholder
+	fake.Password = "env-token"
+	fake.AddManifest("octocat/hello", "latest", "application/vnd.docker.distribution.manifest.v2+json", []byte("{}"))
+	t.Setenv("GITHUB_TOKEN", "env-token")
+
+	args := testArguments("src", fake.URL, "octocat/hello", "latest")
+	*args.Auth = "ghcr"
+	hub, err := connectToRegistry(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hub.ManifestDigest("octocat/hello", "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ping is answered without a repository, so its token has no scope
+	expected := []string{"", "repository:octocat/hello:pull,push"}
+	if scopes := fake.Scopes(); !reflect.DeepEqual(scopes, expected) {
+		t.Errorf("Expected token requests for %v, got %v", expected, scopes)
+	}
+}
+
+// providerRegistry starts a registry that only accepts the credentials the
+// given auth provider finds, and returns the arguments to reach it with that
+// provider. ecrEndpoints maps the region of an ECR hostname to the registry
+// the fake ECR API hands out.
+func providerRegistry(t *testing.T, provider string, prefix string, ecrEndpoints map[string]string) (*fakeRegistry, RepositoryArguments) {
+	fake := newFakeRegistry(t)
+	args := testArguments(prefix, fake.URL, "app", "1.0")
+	switch provider {
+	case "basic":
+		fake.Username, fake.Password = "user", "basic-secret"
+		*args.Username, *args.Password = "user", "basic-secret"
+	case "ecr":
+		// The hostname picks the provider and the region, the fake ECR API
+		// hands out the registry as the endpoint
+		region := map[string]string{"src": "us-east-1", "dest": "eu-west-1"}[prefix]
+		fake.Username, fake.Password = "AWS", "ecr-token"
+		ecrEndpoints[region] = fake.URL
+		*args.RegistryURL = fmt.Sprintf("https://123456789012.dkr.ecr.%s.amazonaws.com", region)
+	case "gcr":
+		fake.Bearer = true
+		fake.Username, fake.Password = gcrUsername, "gcr-token"
+		*args.Auth = "gcr"
+	case "ghcr":
+		fake.Bearer = true
+		fake.Username, fake.Password = ghcrUsernamePlaceholder, "ghcr-token"
+		*args.Auth = "ghcr"
+	case "cred-helper":
+		helper := filepath.Join(t.TempDir(), "helper")
+		script := "#!/bin/sh\ncat > /dev/null\necho '{\"Username\": \"helper\", \"Secret\": \"helper-secret\"}'\n"
+		if err := ioutil.WriteFile(helper, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		fake.Username, fake.Password = "helper", "helper-secret"
+		args.CredHelper = helper
+	}
+	return fake, args
+}
+
+func TestCopyBetweenAuthProviders(t *testing.T) {
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "gcr-token")
+	t.Setenv("GITHUB_TOKEN", "ghcr-token")
+	ecrEndpoints := map[string]string{}
+	defer func(original func(string, string) (*ecr.GetAuthorizationTokenOutput, error)) {
+		ecrAuthorizationToken = original
+	}(ecrAuthorizationToken)
+	ecrAuthorizationToken = func(region string, registryId string) (*ecr.GetAuthorizationTokenOutput, error) {
+		token := base64.StdEncoding.EncodeToString([]byte("AWS:ecr-token"))
+		return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []*ecr.AuthorizationData{{
+			AuthorizationToken: aws.String(token),
+			ProxyEndpoint:      aws.String(ecrEndpoints[region]),
+		}}}, nil
+	}
+
+	providers := []string{"basic", "ecr", "gcr", "ghcr", "cred-helper"}
+	for _, srcProvider := range providers {
+		for _, destProvider := range providers {
+			t.Run(srcProvider+" to "+destProvider, func(t *testing.T) {
+				src, srcArgs := providerRegistry(t, srcProvider, "src", ecrEndpoints)
+				dest, destArgs := providerRegistry(t, destProvider, "dest", ecrEndpoints)
+				image := src.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+
+				srcHub, err := connectToRegistry(srcArgs)
+				if err != nil {
+					t.Fatal(err)
+				}
+				destHub, err := connectToRegistry(destArgs)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = copyImage(srcHub, destHub, "app", "1.0", "app", "1.0", testCopyOptions())
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				manifest, ok := dest.Manifest("app", "1.0")
+				if !ok || string(manifest.Content) != string(image.Manifest) {
+					t.Error("Expected the manifest to be copied unchanged")
+				}
+			})
+		}
+	}
+}
+
+func TestCredHelperStopsAtDeadline(t *testing.T) {
+	helper := filepath.Join(t.TempDir(), "helper")
+	if err := ioutil.WriteFile(helper, []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	deadline, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	provider := &credHelperAuthProvider{Helper: helper, Deadline: deadline}
+	_, _, _, err := provider.Credentials("https://registry.example.com")
+	if exitCodeFor(err) != exitDeadline {
+		t.Errorf("Expected the deadline exit code, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected the helper to be killed at the deadline, it ran for %v", elapsed)
+	}
+}
+
+func TestCredHelperWinsOverRegistryHost(t *testing.T) {
+	for _, url := range []string{"https://ghcr.io", "https://gcr.io", "https://123456789012.dkr.ecr.us-east-1.amazonaws.com", "https://registry.example.com"} {
+		provider, err := selectAuthProvider("auto", url, "", "", "/usr/local/bin/helper", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if provider.Name() != "cred-helper" {
+			t.Errorf("Expected --cred-helper to be used for %s, got %s", url, provider.Name())
+		}
+	}
+
+	provider, err := selectAuthProvider("auto", "https://ghcr.io", "octocat", "token", "/usr/local/bin/helper", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.Name() != "ghcr" {
+		t.Errorf("Expected credentials on the command line to skip the helper, got %s", provider.Name())
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// checkpoint records which copies of a batch completed, so an interrupted
+// batch can be resumed. Each copy is recorded with the digest of the source
+// manifest, so an image that changed in the source since is copied again.
+type checkpoint struct {
+	Path    string                     `json:"-"`
+	Entries map[string]checkpointEntry `json:"entries"`
+}
+
+type checkpointEntry struct {
+	SourceDigest digest.Digest `json:"sourceDigest"`
+	Completed    time.Time     `json:"completed"`
+}
+
+// loadCheckpoint reads a checkpoint file, starting an empty one when the file
+// doesn't exist yet.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	loaded := &checkpoint{Path: path, Entries: map[string]checkpointEntry{}}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return loaded, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, loaded)
+	if err != nil {
+		return nil, err
+	}
+	if loaded.Entries == nil {
+		loaded.Entries = map[string]checkpointEntry{}
+	}
+	return loaded, nil
+}
+
+// Completed tells whether the copy was recorded for the same source digest.
+func (c *checkpoint) Completed(key string, sourceDigest digest.Digest) bool {
+	entry, ok := c.Entries[key]
+	return ok && entry.SourceDigest == sourceDigest
+}
+
+// Record marks a copy as completed and saves the checkpoint right away, so
+// it survives the process being killed.
+func (c *checkpoint) Record(key string, sourceDigest digest.Digest) error {
+	c.Entries[key] = checkpointEntry{SourceDigest: sourceDigest, Completed: time.Now().UTC()}
+
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the file in one go, a checkpoint cut short by a crash would
+	// lose every entry
+	tempFile, err := ioutil.TempFile(filepath.Dir(c.Path), "."+filepath.Base(c.Path))
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(content)
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), c.Path)
+}
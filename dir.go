@@ -0,0 +1,318 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+const (
+	dockerTransportPrefix = "docker://"
+	dirTransportPrefix    = "dir://"
+
+	dirManifestFile = "manifest.json"
+	dirVersionFile  = "version"
+	dirVersion      = "Directory Transport Version: 1.1\n"
+)
+
+// A dir:// image is a local directory holding the manifest in manifest.json
+// and every blob in a file named after its digest, like skopeo's dir:
+// transport. Rather than teaching the copy flow a second way of reading and
+// writing images, dirTransport answers the registry API requests of the
+// registry client from that directory, so a directory can be used anywhere a
+// registry can.
+type dirTransport struct {
+	URL  string
+	Path string
+}
+
+func isDirTransport(registryURL string) bool {
+	return strings.HasPrefix(registryURL, dirTransportPrefix)
+}
+
+func openDirectory(registryURL string) (*registry.Registry, error) {
+	path, err := filepath.Abs(strings.TrimPrefix(registryURL, dirTransportPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve the image directory %s. %v", registryURL, err)
+	}
+
+	url := dirTransportPrefix + path
+	return &registry.Registry{
+		URL: url,
+		Client: &http.Client{
+			Transport: &registry.ErrorTransport{
+				Transport: &dirTransport{URL: url, Path: path},
+			},
+		},
+		Logf: registry.Log,
+	}, nil
+}
+
+func (t *dirTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := strings.TrimPrefix(req.URL.Path, strings.TrimPrefix(t.URL, dirTransportPrefix))
+
+	if path == "/v2/" || path == "/v2" {
+		return dirResponse(req, http.StatusOK, nil), nil
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		return t.manifest(req, path[i+len("/manifests/"):])
+	}
+	if i := strings.LastIndex(path, "/blobs/uploads/"); i >= 0 {
+		return t.upload(req, path[:i], path[i+len("/blobs/uploads/"):])
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		return t.blob(req, path[i+len("/blobs/"):])
+	}
+
+	return dirResponse(req, http.StatusNotFound, nil), nil
+}
+
+// manifest serves the single manifest of the directory whatever the
+// repository and tag asked for are. Manifests referenced by digest, like the
+// images of a manifest list, are kept next to it in files of their own.
+func (t *dirTransport) manifest(req *http.Request, reference string) (*http.Response, error) {
+	manifestFile := dirManifestFile
+	if manifestDigest, err := digest.ParseDigest(reference); err == nil {
+		manifestFile = manifestDigest.Hex() + "." + dirManifestFile
+		if !t.exists(manifestFile) && t.manifestDigest() == manifestDigest {
+			manifestFile = dirManifestFile
+		}
+	}
+	manifestPath := filepath.Join(t.Path, manifestFile)
+
+	switch req.Method {
+	case "GET", "HEAD":
+		content, err := ioutil.ReadFile(manifestPath)
+		if os.IsNotExist(err) {
+			return dirResponse(req, http.StatusNotFound, []byte(`{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`)), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		resp := dirResponse(req, http.StatusOK, content)
+		resp.Header.Set("Content-Type", manifestMediaType(content))
+		resp.Header.Set("Docker-Content-Digest", digest.FromBytes(content).String())
+		if req.Method == "HEAD" {
+			resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+		}
+		return resp, nil
+	case "PUT":
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		err = t.writeFile(manifestFile, bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+
+		resp := dirResponse(req, http.StatusCreated, nil)
+		resp.Header.Set("Docker-Content-Digest", digest.FromBytes(content).String())
+		return resp, nil
+	}
+
+	return dirResponse(req, http.StatusMethodNotAllowed, nil), nil
+}
+
+func (t *dirTransport) exists(name string) bool {
+	_, err := os.Stat(filepath.Join(t.Path, name))
+	return err == nil
+}
+
+// manifestDigest is the digest of the main manifest of the directory, if
+// there is one.
+func (t *dirTransport) manifestDigest() digest.Digest {
+	content, err := ioutil.ReadFile(filepath.Join(t.Path, dirManifestFile))
+	if err != nil {
+		return ""
+	}
+	return digest.FromBytes(content)
+}
+
+func (t *dirTransport) blob(req *http.Request, reference string) (*http.Response, error) {
+	blobDigest, err := digest.ParseDigest(reference)
+	if err != nil {
+		return dirResponse(req, http.StatusBadRequest, nil), nil
+	}
+	blobPath := filepath.Join(t.Path, blobDigest.Hex())
+
+	switch req.Method {
+	case "GET", "HEAD":
+		file, err := os.Open(blobPath)
+		if os.IsNotExist(err) {
+			return dirResponse(req, http.StatusNotFound, []byte(`{"errors":[{"code":"BLOB_UNKNOWN"}]}`)), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		resp := dirResponse(req, http.StatusOK, nil)
+		resp.ContentLength = info.Size()
+		resp.Header.Set("Docker-Content-Digest", blobDigest.String())
+		if req.Method == "GET" {
+			resp.Body = file
+		} else {
+			file.Close()
+		}
+		return resp, nil
+	case "DELETE":
+		err := os.Remove(blobPath)
+		if os.IsNotExist(err) {
+			return dirResponse(req, http.StatusNotFound, nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return dirResponse(req, http.StatusAccepted, nil), nil
+	}
+
+	return dirResponse(req, http.StatusMethodNotAllowed, nil), nil
+}
+
+// upload implements the monolithic upload the registry client does, a POST to
+// start the upload followed by a single PUT with the whole blob.
+func (t *dirTransport) upload(req *http.Request, repositoryPath string, uploadID string) (*http.Response, error) {
+	switch {
+	case req.Method == "POST" && uploadID == "":
+		id := make([]byte, 16)
+		_, err := rand.Read(id)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := dirResponse(req, http.StatusAccepted, nil)
+		resp.Header.Set("Location", fmt.Sprintf("%s%s/blobs/uploads/%s", t.URL, repositoryPath, hex.EncodeToString(id)))
+		return resp, nil
+	case req.Method == "PUT" && uploadID != "":
+		blobDigest, err := digest.ParseDigest(req.URL.Query().Get("digest"))
+		if err != nil {
+			return dirResponse(req, http.StatusBadRequest, []byte(`{"errors":[{"code":"DIGEST_INVALID"}]}`)), nil
+		}
+
+		verifier, err := digest.NewDigestVerifier(blobDigest)
+		if err != nil {
+			return dirResponse(req, http.StatusBadRequest, []byte(`{"errors":[{"code":"DIGEST_INVALID"}]}`)), nil
+		}
+
+		err = t.writeFile(blobDigest.Hex(), &verifiedReader{Reader: req.Body, Verifier: verifier})
+		if err == errBlobDigestMismatch {
+			return dirResponse(req, http.StatusBadRequest, []byte(`{"errors":[{"code":"DIGEST_INVALID"}]}`)), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		resp := dirResponse(req, http.StatusCreated, nil)
+		resp.Header.Set("Docker-Content-Digest", blobDigest.String())
+		return resp, nil
+	}
+
+	return dirResponse(req, http.StatusMethodNotAllowed, nil), nil
+}
+
+// errBlobDigestMismatch is returned by a verifiedReader whose content does
+// not match the digest.
+var errBlobDigestMismatch = errors.New("The blob does not match its digest")
+
+// verifiedReader fails at the end of its content when that does not match
+// the digest, so writeFileAtomically drops the temp file instead of renaming
+// it over a good blob that may already be there.
+type verifiedReader struct {
+	Reader   io.Reader
+	Verifier digest.Verifier
+}
+
+func (r *verifiedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.Verifier.Write(p[:n])
+	if err == io.EOF && !r.Verifier.Verified() {
+		return n, errBlobDigestMismatch
+	}
+	return n, err
+}
+
+// writeFile writes a file of the directory, creating the directory first.
+func (t *dirTransport) writeFile(name string, content io.Reader) error {
+	err := os.MkdirAll(t.Path, 0755)
+	if err != nil {
+		return err
+	}
+
+	versionPath := filepath.Join(t.Path, dirVersionFile)
+	if _, err := os.Stat(versionPath); os.IsNotExist(err) {
+		err = ioutil.WriteFile(versionPath, []byte(dirVersion), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomically(filepath.Join(t.Path, name), content)
+}
+
+// writeFileAtomically writes a file through a temp file next to it, so an
+// interrupted copy never leaves a truncated manifest or blob behind.
+func writeFileAtomically(path string, content io.Reader) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tempFile, content)
+	if err == nil {
+		err = tempFile.Chmod(0644)
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
+
+func dirResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+const doctorTimeout = 10 * time.Second
+
+// doctorCheck is the outcome of one step of the doctor command. A check
+// without an error and not skipped passed.
+type doctorCheck struct {
+	Name    string
+	Skipped string
+	Err     error
+}
+
+// runDoctor checks every step of accessing the source and the destination on
+// its own, so one failure doesn't hide the others, and prints a table of the
+// results. It returns whether every check passed.
+func runDoctor(srcArgs RepositoryArguments, destArgs RepositoryArguments, tempPrefix string) bool {
+	checks := []doctorCheck{}
+	checks = append(checks, doctorRegistryChecks(srcArgs, false)...)
+	checks = append(checks, doctorRegistryChecks(destArgs, true)...)
+	checks = append(checks, doctorCheck{Name: "temp dir is writable", Err: checkTempDir(tempPrefix)})
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "CHECK\tRESULT\tDETAILS")
+	passed := true
+	for _, check := range checks {
+		switch {
+		case check.Err != nil:
+			passed = false
+			fmt.Fprintf(writer, "%s\tFAIL\t%v\n", check.Name, check.Err)
+		case check.Skipped != "":
+			fmt.Fprintf(writer, "%s\tSKIP\t%s\n", check.Name, check.Skipped)
+		default:
+			fmt.Fprintf(writer, "%s\tPASS\t\n", check.Name)
+		}
+	}
+	writer.Flush()
+
+	return passed
+}
+
+// doctorRegistryChecks checks one side of the copy. Checks that depend on an
+// earlier one that failed are skipped.
+func doctorRegistryChecks(args RepositoryArguments, push bool) []doctorCheck {
+	name := func(check string) string {
+		return args.Description + " " + check
+	}
+
+	if isDirTransport(*args.RegistryURL) {
+		hub, err := openDirectory(*args.RegistryURL)
+		return []doctorCheck{{Name: name("directory"), Err: err}, doctorAccessCheck(args, hub, push, name)}
+	}
+	if isOCILayoutTransport(*args.RegistryURL) {
+		hub, err := openOCILayout(*args.RegistryURL)
+		return []doctorCheck{{Name: name("directory"), Err: err}, doctorAccessCheck(args, hub, push, name)}
+	}
+
+	checks := []doctorCheck{}
+	parsed, err := neturl.Parse(*args.RegistryURL)
+	if err == nil && parsed.Host == "" {
+		err = fmt.Errorf("%s is not a URL", *args.RegistryURL)
+	}
+	if err != nil {
+		return append(checks, doctorCheck{Name: name("registry URL"), Err: err})
+	}
+
+	_, err = net.LookupHost(parsed.Hostname())
+	checks = append(checks, doctorCheck{Name: name("DNS resolution"), Err: err})
+
+	tlsCheck := doctorCheck{Name: name("TLS handshake")}
+	if parsed.Scheme != "https" {
+		tlsCheck.Skipped = "not using https"
+	} else if err != nil {
+		tlsCheck.Skipped = "DNS resolution failed"
+	} else {
+		tlsCheck.Err = checkTLSHandshake(parsed, args)
+	}
+	checks = append(checks, tlsCheck)
+
+	challenge, err := pingRegistry(args)
+	checks = append(checks, doctorCheck{Name: name("ping"), Err: err})
+	if err != nil {
+		return append(checks,
+			doctorCheck{Name: name("credentials"), Skipped: "ping failed"},
+			doctorCheck{Name: name("token"), Skipped: "ping failed"},
+			doctorCheck{Name: name(accessCheckName(push)), Skipped: "ping failed"})
+	}
+
+	url, username, password, err := registryCredentials(args)
+	checks = append(checks, doctorCheck{Name: name("credentials"), Err: err})
+	if err != nil {
+		return append(checks,
+			doctorCheck{Name: name("token"), Skipped: "no credentials"},
+			doctorCheck{Name: name(accessCheckName(push)), Skipped: "no credentials"})
+	}
+
+	// Connecting pings the registry again, this time answering its challenge,
+	// which is where the token is requested
+	hub, err := openRegistry(args, url, username, password)
+	tokenCheck := doctorCheck{Name: name("token"), Err: err}
+	if err == nil && !strings.HasPrefix(strings.ToLower(challenge), "bearer") {
+		tokenCheck.Skipped = "the registry does not ask for a token"
+	}
+	checks = append(checks, tokenCheck)
+	if err != nil {
+		return append(checks, doctorCheck{Name: name(accessCheckName(push)), Skipped: "token failed"})
+	}
+
+	return append(checks, doctorAccessCheck(args, hub, push, name))
+}
+
+// pingRegistry checks that the registry answers the version check of the
+// registry API, without credentials. Registries that require them answer
+// with a challenge, which is returned.
+func pingRegistry(args RepositoryArguments) (string, error) {
+	transport, err := baseTransport(args)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{
+		Transport: &headerTransport{Transport: transport, UserAgent: *args.UserAgent, Headers: *args.Headers},
+		Timeout:   doctorTimeout,
+	}
+
+	resp, err := client.Get(registryBaseURL(*args.RegistryURL) + "/v2/")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return "", fmt.Errorf("%s/v2/ answered with %s, it may not be a registry", registryBaseURL(*args.RegistryURL), resp.Status)
+	}
+	return resp.Header.Get("WWW-Authenticate"), nil
+}
+
+func accessCheckName(push bool) string {
+	if push {
+		return "push permission"
+	}
+	return "pull permission"
+}
+
+// doctorAccessCheck checks that the source image can be pulled, or that the
+// destination repository can be pushed to.
+func doctorAccessCheck(args RepositoryArguments, hub *registry.Registry, push bool, name func(string) string) doctorCheck {
+	check := doctorCheck{Name: name(accessCheckName(push))}
+	if hub == nil {
+		check.Skipped = "no connection"
+		return check
+	}
+
+	if push && isDirTransport(*args.RegistryURL) {
+		check.Err = checkDirectoryWritable(strings.TrimPrefix(hub.URL, dirTransportPrefix))
+	} else if push && isOCILayoutTransport(*args.RegistryURL) {
+		check.Err = checkDirectoryWritable(strings.TrimPrefix(hub.URL, ociTransportPrefix))
+	} else if push {
+		check.Err = checkPushPermission(hub, *args.Repository)
+	} else {
+		mediaTypes := append(append([]string{}, imageManifestMediaTypes...), indexMediaTypes...)
+		_, _, check.Err = getManifest(hub, *args.Repository, args.Reference(), mediaTypes)
+	}
+	return check
+}
+
+// checkTLSHandshake completes a handshake with the registry, presenting the
+// client certificate when one was given.
+func checkTLSHandshake(parsed *neturl.URL, args RepositoryArguments) error {
+	address := parsed.Host
+	if parsed.Port() == "" {
+		address = net.JoinHostPort(parsed.Hostname(), "443")
+	}
+
+	config, err := clientTLSConfig(args)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.ServerName = parsed.Hostname()
+
+	dialer := &net.Dialer{Timeout: doctorTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkDirectoryWritable checks that an image directory can be written,
+// without creating it: when it doesn't exist yet, the closest existing parent
+// has to be writable instead.
+func checkDirectoryWritable(path string) error {
+	for {
+		_, err := os.Stat(path)
+		if err == nil || !os.IsNotExist(err) || filepath.Dir(path) == path {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	return checkWritable(path, ".copy-docker-image")
+}
+
+func checkTempDir(prefix string) error {
+	return checkWritable("", prefix)
+}
+
+func checkWritable(dir string, prefix string) error {
+	tempFile, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.WriteString(strings.Repeat("x", 1024))
+	tempFile.Close()
+	removeErr := os.Remove(tempFile.Name())
+	if err == nil {
+		err = removeErr
+	}
+	return err
+}
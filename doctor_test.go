@@ -0,0 +1,79 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// doctorResults sums up checks as "name: PASS", "name: SKIP reason" or
+// "name: FAIL".
+func doctorResults(checks []doctorCheck) map[string]string {
+	results := map[string]string{}
+	for _, check := range checks {
+		switch {
+		case check.Err != nil:
+			results[check.Name] = "FAIL"
+		case check.Skipped != "":
+			results[check.Name] = "SKIP " + check.Skipped
+		default:
+			results[check.Name] = "PASS"
+		}
+	}
+	return results
+}
+
+func TestDoctorPingAndToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		bearer   bool
+		password string
+		stopped  bool
+		ping     string
+		token    string
+		access   string
+	}{
+		{name: "token granted", bearer: true, password: "secret", ping: "PASS", token: "PASS", access: "PASS"},
+		{name: "token refused", bearer: true, password: "wrong", ping: "PASS", token: "FAIL", access: "SKIP token failed"},
+		{name: "no token needed", ping: "PASS", token: "SKIP the registry does not ask for a token", access: "PASS"},
+		{name: "registry down", bearer: true, password: "secret", stopped: true, ping: "FAIL", token: "SKIP ping failed", access: "SKIP ping failed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeRegistry(t)
+			fake.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+			if test.bearer {
+				fake.Bearer = true
+				fake.Password = "secret"
+			}
+			if test.stopped {
+				fake.Close()
+			}
+
+			args := testArguments("src", fake.URL, "app", "1.0")
+			*args.Username = "user"
+			*args.Password = test.password
+			results := doctorResults(doctorRegistryChecks(args, false))
+
+			expected := map[string]string{"src ping": test.ping, "src token": test.token, "src pull permission": test.access}
+			for name, result := range expected {
+				if !strings.HasPrefix(results[name], result) {
+					t.Errorf("Expected %s to be %s, got %s", name, result, results[name])
+				}
+			}
+		})
+	}
+}
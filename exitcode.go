@@ -0,0 +1,61 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+)
+
+// Exit codes of the program, so scripts can tell the kinds of failures apart.
+const (
+	exitFailure        = 1
+	exitUsage          = 2
+	exitAuth           = 3
+	exitSourceNotFound = 4
+	exitTransfer       = 5
+	exitDeadline       = 6
+)
+
+// exitError attaches the exit code a failure should end the program with,
+// because the original error is lost once it is wrapped into a message.
+type exitError struct {
+	Code int
+	Err  error
+}
+
+func (e *exitError) Error() string {
+	return e.Err.Error()
+}
+
+// withExitCode wraps err with the exit code cause calls for, or fallback
+// when cause does not tell what kind of failure it was.
+func withExitCode(cause error, fallback int, err error) error {
+	code := exitCodeFor(cause)
+	if code == exitFailure {
+		code = fallback
+	}
+	return &exitError{Code: code, Err: err}
+}
+
+func exitCodeFor(err error) int {
+	if exitErr, ok := err.(*exitError); ok {
+		return exitErr.Code
+	}
+	httpErr := httpStatusError(err)
+	if httpErr != nil && (httpErr.Response.StatusCode == http.StatusUnauthorized || httpErr.Response.StatusCode == http.StatusForbidden) {
+		return exitAuth
+	}
+	return exitFailure
+}
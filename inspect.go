@@ -0,0 +1,185 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/docker/distribution/digest"
+)
+
+// Output formats of the read-only commands. Without --output-format, a
+// table is printed on a terminal and the format a script needs otherwise.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputPlain = "plain"
+)
+
+// outputFormatFlag adds --output-format to a read-only command.
+func outputFormatFlag(command *kingpin.CmdClause) *string {
+	return command.Flag("output-format", "Print a table, JSON or plain values, one per line. Defaults to a table on a terminal").Enum(outputTable, outputJSON, outputPlain)
+}
+
+// outputFormat picks the format given with --output-format, or the default
+// for where the output goes.
+func outputFormat(format string, notTerminal string) string {
+	if format != "" {
+		return format
+	}
+	if isTerminal(os.Stdout) {
+		return outputTable
+	}
+	return notTerminal
+}
+
+// imageSummary is what the inspect command reports about an image, a
+// manifest list or an artifact.
+type imageSummary struct {
+	Image     string        `json:"image"`
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size,omitempty"`
+	Config    *descriptor   `json:"config,omitempty"`
+	Layers    []descriptor  `json:"layers,omitempty"`
+	Manifests []descriptor  `json:"manifests,omitempty"`
+}
+
+// runTags lists the tags of the source repository. The plain format has one
+// tag per line.
+func runTags(args RepositoryArguments, format string) error {
+	hub, err := connectToRegistry(args)
+	if err != nil {
+		return withExitCode(err, exitFailure, fmt.Errorf("Failed to establish a connection to the source registry. %v", err))
+	}
+
+	tags, err := hub.Tags(*args.Repository)
+	if err != nil {
+		return withExitCode(err, exitFailure, fmt.Errorf("Failed to list the tags of %s/%s. %v", hub.URL, *args.Repository, err))
+	}
+
+	switch format {
+	case outputJSON:
+		return printJSON(tags)
+	case outputTable:
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "TAG")
+		for _, tag := range tags {
+			fmt.Fprintln(writer, tag)
+		}
+		return writer.Flush()
+	}
+	for _, tag := range tags {
+		fmt.Println(tag)
+	}
+	return nil
+}
+
+// runInspect summarizes the manifest of the source image without copying
+// anything. The plain format has the digest of the manifest on the first
+// line, followed by the digest of every blob or manifest it references.
+func runInspect(args RepositoryArguments, format string) error {
+	hub, err := connectToRegistry(args)
+	if err != nil {
+		return withExitCode(err, exitFailure, fmt.Errorf("Failed to establish a connection to the source registry. %v", err))
+	}
+
+	repository, reference := *args.Repository, args.Reference()
+	mediaTypes := append(append(append([]string{}, indexMediaTypes...), imageManifestMediaTypes...), ociArtifactManifestMediaType)
+	content, mediaType, err := getManifest(hub, repository, reference, mediaTypes)
+	if err != nil {
+		fetchErr := fmt.Errorf("Failed to fetch the manifest for %s/%s:%s. %v", hub.URL, repository, reference, err)
+		if isManifestUnknown(err) {
+			return &exitError{Code: exitSourceNotFound, Err: fetchErr}
+		}
+		return withExitCode(err, exitFailure, fetchErr)
+	}
+	manifest, err := parseRawManifest(content)
+	if err != nil {
+		return withExitCode(err, exitFailure, fmt.Errorf("Failed to parse the manifest of %s/%s:%s. %v", hub.URL, repository, reference, err))
+	}
+
+	summary := imageSummary{
+		Image:     resolvedImageName(hub.URL, repository, reference),
+		Digest:    manifestDigest(content, mediaType),
+		MediaType: mediaType,
+		Config:    manifest.Config,
+		Manifests: manifest.Manifests,
+	}
+	for _, blob := range manifest.BlobDescriptors() {
+		if manifest.Config == nil || blob.Digest != manifest.Config.Digest {
+			summary.Layers = append(summary.Layers, blob)
+		}
+		summary.Size += blob.Size
+	}
+
+	switch format {
+	case outputJSON:
+		return printJSON(summary)
+	case outputTable:
+		return printImageSummary(summary)
+	}
+	fmt.Println(summary.Digest)
+	if summary.Config != nil {
+		fmt.Println(summary.Config.Digest)
+	}
+	for _, entry := range append(summary.Layers, summary.Manifests...) {
+		fmt.Println(entry.Digest)
+	}
+	return nil
+}
+
+func printImageSummary(summary imageSummary) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "Image:\t%s\n", summary.Image)
+	fmt.Fprintf(writer, "Digest:\t%s\n", summary.Digest)
+	fmt.Fprintf(writer, "Media type:\t%s\n", summary.MediaType)
+	if summary.Config != nil {
+		fmt.Fprintf(writer, "Config:\t%s\n", summary.Config.Digest)
+	}
+	// schema1 manifests don't record the size of the layers
+	if len(summary.Manifests) == 0 && !isSchema1MediaType(summary.MediaType) {
+		fmt.Fprintf(writer, "Size:\t%s\n", formatBytes(summary.Size))
+	}
+	err := writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	writer = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if len(summary.Manifests) > 0 {
+		fmt.Fprintln(writer, "PLATFORM\tDIGEST\tSIZE\tMEDIA TYPE")
+		for _, entry := range summary.Manifests {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", entry.Platform, entry.Digest, formatBytes(entry.Size), entry.MediaType)
+		}
+	} else {
+		fmt.Fprintln(writer, "LAYER\tSIZE\tMEDIA TYPE")
+		for _, entry := range summary.Layers {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", entry.Digest, formatBytes(entry.Size), entry.MediaType)
+		}
+	}
+	return writer.Flush()
+}
+
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
@@ -0,0 +1,34 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestReadOnlyCommandsKeepExitCodes(t *testing.T) {
+	fake := newFakeRegistry(t)
+	fake.Username, fake.Password = "octocat", "secret"
+	fake.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+
+	args := testArguments("src", fake.BaseURL(), "app", "1.0")
+	*args.Username, *args.Password = "octocat", "wrong"
+	if err := runTags(args, outputPlain); exitCodeFor(err) != exitAuth {
+		t.Errorf("Expected tags with the wrong password to exit with %d, got %d: %v", exitAuth, exitCodeFor(err), err)
+	}
+	if err := runInspect(args, outputJSON); exitCodeFor(err) != exitAuth {
+		t.Errorf("Expected inspect with the wrong password to exit with %d, got %d: %v", exitAuth, exitCodeFor(err), err)
+	}
+}
@@ -15,83 +15,963 @@ limitations under the License.
 package main
 
 import (
-	"encoding/base64"
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/alecthomas/kingpin"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/docker/distribution/digest"
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/heroku/docker-registry-client/registry"
 	"io"
 	"io/ioutil"
+	"net/http"
+	neturl "net/url"
 	"os"
+	"path"
 	"strings"
-	"regexp"
+	"time"
 )
 
-func moveLayerUsingFile(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, layer schema1.FSLayer, file *os.File) error {
-	layerDigest := layer.BlobSum
+func moveLayerUsingFile(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, layerDigest digest.Digest, file *os.File, reservation *tempReservation, options copyOptions) error {
+	downloaded := false
+	if options.DownloadSegments > 1 {
+		var err error
+		downloaded, err = downloadBlobInSegments(srcHub, srcRepo, layerDigest, file, options.DownloadSegments, options.LayerRetry)
+		if err != nil {
+			return fmt.Errorf("Failure while downloading an image layer in segments. %v", err)
+		}
+		if !downloaded {
+			fmt.Println("The source registry does not support segmented downloads, downloading layer", layerDigest, "at once")
+		}
+	}
+
+	if !downloaded {
+		err := retryTransient("Downloading layer "+layerDigest.String(), options.LayerRetry, func() error {
+			// Start over with an empty file on every attempt
+			_, err := file.Seek(0, io.SeekStart)
+			if err == nil {
+				err = file.Truncate(0)
+			}
+			if err != nil {
+				return err
+			}
+
+			srcImageReader, err := srcHub.DownloadLayer(srcRepo, layerDigest)
+			if err != nil {
+				return err
+			}
+			defer srcImageReader.Close()
+			_, err = io.Copy(reservation.Writer(file), srcImageReader)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Failure while downloading an image layer to a temp file. %v", err)
+		}
+	}
+
+	return uploadLayerFromFile(destHub, destRepo, layerDigest, file, options.LayerRetry)
+}
+
+func uploadLayerFromFile(destHub *registry.Registry, destRepo string, layerDigest digest.Digest, file *os.File, policy retryPolicy) error {
+	file.Sync()
+
+	err := retryTransient("Uploading layer "+layerDigest.String(), policy, func() error {
+		imageReadStream, err := os.Open(file.Name())
+		if err != nil {
+			return fmt.Errorf("Failed to open temporary image layer for uploading. %v", err)
+		}
+		defer imageReadStream.Close()
+		return destHub.UploadLayer(destRepo, layerDigest, imageReadStream)
+	})
+	if err != nil {
+		return fmt.Errorf("Failure while uploading the image. %v", err)
+	}
+
+	return nil
+}
+
+// moveLayerUsingMemory keeps a small layer in memory instead of writing it
+// to a temp file. When the size of the layer is not known up front and it
+// turns out to be larger than the threshold, the part read so far and the
+// rest of the layer are spilled to a temp file after all.
+func moveLayerUsingMemory(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, layerDigest digest.Digest, options copyOptions) error {
+	var srcImageReader io.ReadCloser
+	var buffer bytes.Buffer
+	complete := false
+	err := retryTransient("Downloading layer "+layerDigest.String(), options.LayerRetry, func() error {
+		if srcImageReader != nil {
+			srcImageReader.Close()
+		}
+		buffer.Reset()
+
+		var err error
+		srcImageReader, err = srcHub.DownloadLayer(srcRepo, layerDigest)
+		if err != nil {
+			srcImageReader = nil
+			return err
+		}
+		_, err = io.CopyN(&buffer, srcImageReader, options.MemoryThreshold+1)
+		complete = err == io.EOF
+		if complete {
+			return nil
+		}
+		return err
+	})
+	if srcImageReader != nil {
+		defer srcImageReader.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("Failure while downloading an image layer. %v", err)
+	}
+
+	if complete {
+		err = retryTransient("Uploading layer "+layerDigest.String(), options.LayerRetry, func() error {
+			return destHub.UploadLayer(destRepo, layerDigest, bytes.NewReader(buffer.Bytes()))
+		})
+		if err != nil {
+			return fmt.Errorf("Failure while uploading the image. %v", err)
+		}
+		return nil
+	}
+
+	return withTempFile(options.TempPrefix, options.TempBudget, int64(buffer.Len()), func(file *os.File, reservation *tempReservation) error {
+		_, err := io.Copy(reservation.Writer(file), io.MultiReader(&buffer, srcImageReader))
+		if err != nil {
+			return fmt.Errorf("Failure while copying the image layer to a temp file. %v", err)
+		}
+		return uploadLayerFromFile(destHub, destRepo, layerDigest, file, options.LayerRetry)
+	})
+}
+
+// withTempFile runs use with a fresh temp file that is removed afterwards.
+// size bytes of the temp budget are reserved for the file before it is
+// created, more as writes through the reservation need them, and all of it
+// is released once the file is removed.
+func withTempFile(prefix string, budget *tempBudget, size int64, use func(file *os.File, reservation *tempReservation) error) error {
+	if size < 0 {
+		size = 0
+	}
+	err := budget.Reserve(size)
+	if err != nil {
+		return err
+	}
+	reservation := &tempReservation{budget: budget, size: size}
+	defer func() { budget.Release(reservation.size) }()
+
+	tempFile, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return fmt.Errorf("Failure while creating temporary file for an image layer download. %v", err)
+	}
+
+	err = use(tempFile, reservation)
+	tempFile.Close()
+	removeErr := os.Remove(tempFile.Name())
+	if removeErr != nil {
+		// Print the error but don't fail the whole migration just because of a leaked temp file
+		fmt.Printf("Failed to remove image layer temp file %s. %v", tempFile.Name(), removeErr)
+	}
+
+	return err
+}
+
+// streamLayer uploads a layer while it is still being downloaded, which
+// overlaps both transfers at the cost of holding no local copy of the layer.
+func streamLayer(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, layerDigest digest.Digest, policy retryPolicy) error {
+	// Nothing of the layer is kept, so a retry downloads it again
+	err := retryTransient("Streaming layer "+layerDigest.String(), policy, func() error {
+		srcImageReader, err := srcHub.DownloadLayer(srcRepo, layerDigest)
+		if err != nil {
+			return err
+		}
+		defer srcImageReader.Close()
+		return destHub.UploadLayer(destRepo, layerDigest, srcImageReader)
+	})
+	if err != nil {
+		return fmt.Errorf("Failure while streaming the image layer to the destination. %v", err)
+	}
+
+	return nil
+}
+
+// copyOptions tunes how an image is copied.
+type copyOptions struct {
+	VerifyExistingLayers    bool
+	OverwriteExistingLayers bool
+	CleanupOnFailure        bool
+	ManifestRetry           retryPolicy
+	LayerRetry              retryPolicy
+	StreamLayers            bool
+	DownloadSegments        int
+	Artifact                bool
+	DryRun                  bool
+	TempPrefix              string
+	MemoryThreshold         int64
+	MountLayers             bool
+	AllPlatforms            bool
+	RewriteRefs             map[string]string
+	Since                   time.Time
+	Recompress              string
+	MediaTypes              mediaTypePolicy
+	ForceSchema1            bool
+	Strict                  bool
+	CopyReferrers           bool
+	MaxTempBytes            int64
+	TempBudget              *tempBudget
+	VerifyPull              bool
+	ContinueOnMissingLayer  bool
+	Tally                   *copyTally
+}
+
+// verifyExistingLayer checks that a layer the destination claims to have
+// matches the source in size and actually hashes to its digest.
+func verifyExistingLayer(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, layerDigest digest.Digest) (bool, error) {
+	srcMetadata, err := srcHub.LayerMetadata(srcRepo, layerDigest)
+	if err != nil {
+		return false, fmt.Errorf("Failure while looking up the size of a source image layer. %v", err)
+	}
+	destMetadata, err := destHub.LayerMetadata(destRepo, layerDigest)
+	if err != nil {
+		return false, fmt.Errorf("Failure while looking up the size of a destination image layer. %v", err)
+	}
+	if srcMetadata.Size != destMetadata.Size {
+		fmt.Printf("Layer %s is %d bytes in the source but %d bytes in the destination\n", layerDigest, srcMetadata.Size, destMetadata.Size)
+		return false, nil
+	}
+
+	verifier, err := digest.NewDigestVerifier(layerDigest)
+	if err != nil {
+		return false, fmt.Errorf("Failure while preparing to verify image layer %s. %v", layerDigest, err)
+	}
+	destReader, err := destHub.DownloadLayer(destRepo, layerDigest)
+	if err != nil {
+		return false, fmt.Errorf("Failure while starting the download of a destination image layer. %v", err)
+	}
+	_, err = io.Copy(verifier, destReader)
+	destReader.Close()
+	if err != nil {
+		return false, fmt.Errorf("Failure while downloading a destination image layer. %v", err)
+	}
+
+	return verifier.Verified(), nil
+}
+
+// migrateLayer copies a layer to the destination unless it is already there
+// and reports whether it had to be uploaded.
+func migrateLayer(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, layer descriptor, options copyOptions) (bool, error) {
+	fmt.Println("Checking if manifest layer exists in destination registery")
+
+	layerDigest := layer.Digest
+	var hasLayer bool
+	err := retryTransient("Checking layer "+layerDigest.String(), options.LayerRetry, func() error {
+		var err error
+		hasLayer, err = destHub.HasLayer(destRepo, layerDigest)
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("Failure while checking if the destination registry contained an image layer. %v", err)
+	}
+
+	if hasLayer && options.OverwriteExistingLayers {
+		fmt.Println("Layer already exists in the destination but will be uploaded again")
+		hasLayer = false
+	} else if hasLayer && options.VerifyExistingLayers {
+		fmt.Println("Verifying layer", layerDigest, "in the destination")
+		valid, err := verifyExistingLayer(srcHub, destHub, srcRepo, destRepo, layerDigest)
+		if err != nil {
+			return false, err
+		}
+		if !valid {
+			fmt.Println("Layer", layerDigest, "in the destination does not match the source and will be uploaded again")
+			hasLayer = false
+		}
+	}
+
+	if !hasLayer && options.MountLayers && srcRepo != destRepo &&
+		normalizeRegistryURL(srcHub.URL) == normalizeRegistryURL(destHub.URL) {
+		mounted, err := mountBlob(destHub, destRepo, srcRepo, layerDigest)
+		if err != nil {
+			fmt.Println("Failed to mount layer", layerDigest, "from", srcRepo, "falling back to a full upload.", err)
+		} else if mounted {
+			fmt.Println("Mounted layer", layerDigest, "from", srcRepo)
+			return true, nil
+		} else {
+			fmt.Println("The destination did not mount layer", layerDigest, "falling back to a full upload")
+		}
+	}
+
+	if !hasLayer {
+		fmt.Println("Need to upload layer", layerDigest, "to the destination")
+		transferProgress.Expect(layer.Size)
+		if options.StreamLayers {
+			err = streamLayer(srcHub, destHub, srcRepo, destRepo, layerDigest, options.LayerRetry)
+			return err == nil, err
+		}
+
+		// Layers of unknown size are only buffered when they don't need a
+		// file for a segmented download, or a spill to a file that could
+		// exceed the temp budget
+		fitsInMemory := layer.Size > 0 && layer.Size <= options.MemoryThreshold ||
+			layer.Size <= 0 && options.DownloadSegments <= 1 && options.MaxTempBytes <= 0
+		if options.MemoryThreshold > 0 && fitsInMemory {
+			err = moveLayerUsingMemory(srcHub, destHub, srcRepo, destRepo, layerDigest, options)
+			return err == nil, err
+		}
+
+		if options.MaxTempBytes > 0 && (layer.Size <= 0 || layer.Size > options.MaxTempBytes) {
+			fmt.Println("Layer", layerDigest, "may not fit in", formatBytes(options.MaxTempBytes), "of temp space, streaming it instead")
+			err = streamLayer(srcHub, destHub, srcRepo, destRepo, layerDigest, options.LayerRetry)
+			return err == nil, err
+		}
+
+		err = withTempFile(options.TempPrefix, options.TempBudget, layer.Size, func(file *os.File, reservation *tempReservation) error {
+			return moveLayerUsingFile(srcHub, destHub, srcRepo, destRepo, layerDigest, file, reservation, options)
+		})
+		return err == nil, err
+	} else {
+		fmt.Println("Layer already exists in the destination")
+		return false, nil
+	}
+}
+
+// cleanupUploadedLayers tries to delete the layers uploaded by a copy that
+// did not get as far as publishing the manifest. Registries often have
+// deletion disabled, so failures are only reported.
+func cleanupUploadedLayers(destHub *registry.Registry, destRepo string, uploaded []digest.Digest) {
+	for _, layerDigest := range uploaded {
+		err := deleteBlob(destHub, destRepo, layerDigest)
+		if err != nil {
+			fmt.Printf("Failed to delete uploaded layer %s. %v\n", layerDigest, err)
+		} else {
+			fmt.Println("Deleted uploaded layer", layerDigest)
+		}
+	}
+}
+
+// migrateLayers copies every layer that is missing in the destination and
+// returns the ones it uploaded, also when it fails part way.
+func migrateLayers(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, layers []descriptor, options copyOptions) ([]digest.Digest, error) {
+	uploadedLayers := []digest.Digest{}
+	missingLayers := []string{}
+	for _, layer := range layers {
+		uploaded, err := migrateLayer(srcHub, destHub, srcRepo, destRepo, layer, options)
+		if err != nil && options.ContinueOnMissingLayer && isMissingInSource(srcHub, srcRepo, layer.Digest) {
+			fmt.Println("Layer", layer.Digest, "is MISSING in the source, continuing with the other layers")
+			missingLayers = append(missingLayers, layer.Digest.String())
+			continue
+		}
+		if err != nil {
+			return uploadedLayers, err
+		}
+		if uploaded {
+			uploadedLayers = append(uploadedLayers, layer.Digest)
+		}
+		options.Tally.Blob(uploaded, layer.Size)
+	}
+
+	if len(missingLayers) > 0 {
+		return uploadedLayers, fmt.Errorf("%d layer(s) are missing in the source, so the manifest was not pushed:\n  %s", len(missingLayers), strings.Join(missingLayers, "\n  "))
+	}
+	return uploadedLayers, nil
+}
+
+// pushImageBlobs makes sure every blob of an image is in the destination,
+// the layers copied from the source and the rewritten config, if any,
+// uploaded from memory. It only returns once each of them is confirmed
+// present or has failed, and returns the blobs it uploaded.
+func pushImageBlobs(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, layers []descriptor, rewrittenConfig []byte, options copyOptions) ([]digest.Digest, error) {
+	uploadedBlobs, err := migrateLayers(srcHub, destHub, srcRepo, destRepo, layers, options)
+	if err != nil {
+		return uploadedBlobs, withExitCode(err, exitTransfer, fmt.Errorf("Failed to migrate image layer. %v", err))
+	}
+
+	if rewrittenConfig != nil {
+		configDigest := digest.FromBytes(rewrittenConfig)
+		var uploaded bool
+		err := retryTransient("Uploading the rewritten image config", options.LayerRetry, func() error {
+			var err error
+			uploaded, err = uploadBlob(destHub, destRepo, configDigest, rewrittenConfig)
+			return err
+		})
+		if uploaded {
+			uploadedBlobs = append(uploadedBlobs, configDigest)
+		}
+		if err != nil {
+			return uploadedBlobs, withExitCode(err, exitTransfer, fmt.Errorf("Failed to upload the rewritten image config. %v", err))
+		}
+	}
+	return uploadedBlobs, nil
+}
+
+// isMissingInSource tells whether a layer that failed to copy is missing in
+// the source, as with a registry that garbage collected it.
+func isMissingInSource(srcHub *registry.Registry, srcRepo string, layerDigest digest.Digest) bool {
+	exists, err := srcHub.HasLayer(srcRepo, layerDigest)
+	return err == nil && !exists
+}
+
+// reportLayerDelta compares the layers of the image being copied with the
+// image the destination tag points at right now, to show how much of the
+// copy is actually new.
+func reportLayerDelta(destHub *registry.Registry, destRepo string, destTag string, layers []descriptor) {
+	mediaTypes := append(append([]string{}, imageManifestMediaTypes...), ociArtifactManifestMediaType)
+	content, _, err := getManifest(destHub, destRepo, destTag, mediaTypes)
+	if err != nil && isManifestUnknown(err) {
+		fmt.Printf("The destination has no image at %s:%s yet\n", destRepo, destTag)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to fetch the current destination manifest to compare layers. %v\n", err)
+		return
+	}
+	current, err := parseRawManifest(content)
+	if err != nil {
+		fmt.Printf("Failed to parse the current destination manifest to compare layers. %v\n", err)
+		return
+	}
+
+	existing := map[digest.Digest]bool{}
+	for _, layer := range current.BlobDescriptors() {
+		existing[layer.Digest] = true
+	}
+
+	newLayers := []digest.Digest{}
+	reused := 0
+	seen := map[digest.Digest]bool{}
+	for _, layer := range layers {
+		if seen[layer.Digest] {
+			continue
+		}
+		seen[layer.Digest] = true
+
+		if existing[layer.Digest] {
+			reused++
+		} else {
+			newLayers = append(newLayers, layer.Digest)
+		}
+	}
+
+	fmt.Printf("Compared to the current %s:%s, new layers: %d, reused: %d\n", destRepo, destTag, len(newLayers), reused)
+	for _, layerDigest := range newLayers {
+		fmt.Println("New layer", layerDigest)
+	}
+}
+
+// reportDryRun prints which layers a copy would transfer and how many bytes
+// that adds up to. Sizes come from the manifest when it records them and
+// from HEAD requests to the source otherwise.
+func reportDryRun(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, layers []descriptor) error {
+	missing := 0
+	var total int64
+	seen := map[digest.Digest]bool{}
+	for _, layer := range layers {
+		// schema1 manifests repeat the digest of empty layers
+		if seen[layer.Digest] {
+			continue
+		}
+		seen[layer.Digest] = true
+
+		hasLayer, err := destHub.HasLayer(destRepo, layer.Digest)
+		if err != nil {
+			return fmt.Errorf("Failure while checking if the destination registry contained an image layer. %v", err)
+		}
+		if hasLayer {
+			fmt.Println("Layer", layer.Digest, "already exists in the destination")
+			continue
+		}
+
+		size := layer.Size
+		if size <= 0 {
+			metadata, err := srcHub.LayerMetadata(srcRepo, layer.Digest)
+			if err != nil {
+				return fmt.Errorf("Failure while looking up the size of a source image layer. %v", err)
+			}
+			size = metadata.Size
+		}
+
+		fmt.Printf("Layer %s would be copied (%s)\n", layer.Digest, formatBytes(size))
+		missing++
+		total += size
+	}
+
+	fmt.Printf("Dry run: %d of %d layer(s) would be copied, %s in total\n", missing, len(seen), formatBytes(total))
+	return nil
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	suffixes := []string{"KiB", "MiB", "GiB", "TiB"}
+	suffix := ""
+	for _, suffix = range suffixes {
+		value /= unit
+		if value < unit {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
+
+func reportIncompleteCopy(destHub *registry.Registry, destRepo string, uploadedLayers []digest.Digest, options copyOptions) {
+	if len(uploadedLayers) == 0 {
+		return
+	}
+	fmt.Printf("\n%d layer(s) were uploaded to %s/%s but the image was NOT published. The destination is in an incomplete state\n", len(uploadedLayers), destHub.URL, destRepo)
+	if options.CleanupOnFailure {
+		cleanupUploadedLayers(destHub, destRepo, uploadedLayers)
+	}
+}
+
+func manifestUploadError(destHub *registry.Registry, destRepo string, destTag string, err error) error {
+	if isImmutableTagError(err) {
+		return &exitError{Code: exitTransfer, Err: fmt.Errorf("Destination tag %s of %s/%s is immutable; choose a different tag or delete it first", destTag, destHub.URL, destRepo)}
+	}
+	return withExitCode(err, exitTransfer, fmt.Errorf("Failed to upload manifest to %s/%s:%s. %v", destHub.URL, destRepo, destTag, err))
+}
+
+// copyImage copies a single tagged image, layers first and then the manifest
+// that publishes it. schema2 and OCI manifests are content addressable and
+// are pushed byte for byte so their digest stays the same, only schema1
+// manifests embed the repository name and have to be rewritten. It returns
+// the source manifest, as it was when the copy fetched it.
+func copyImage(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, srcTag string, destRepo string, destTag string, options copyOptions) (descriptor, error) {
+	mediaTypes := sourceMediaTypes(options)
+
+	var content []byte
+	var mediaType string
+	err := retryOnManifestUnknown(srcRepo, srcTag, options.ManifestRetry, func() error {
+		var err error
+		content, mediaType, err = getManifest(srcHub, srcRepo, srcTag, mediaTypes)
+		return err
+	})
+	if err != nil {
+		fetchErr := fmt.Errorf("Failed to fetch the manifest for %s/%s:%s. %v", srcHub.URL, srcRepo, srcTag, err)
+		if isManifestUnknown(err) {
+			return descriptor{}, &exitError{Code: exitSourceNotFound, Err: fetchErr}
+		}
+		return descriptor{}, withExitCode(err, exitTransfer, fetchErr)
+	}
+
+	source := descriptor{MediaType: mediaType, Digest: digest.FromBytes(content), Size: int64(len(content))}
+
+	err = checkManifestDigests(srcHub, srcRepo, srcTag, destTag, mediaType, content, options)
+	if err != nil {
+		return source, err
+	}
+
+	if options.ForceSchema1 && !isSchema1MediaType(mediaType) {
+		return source, fmt.Errorf("The source registry has no schema1 manifest for %s/%s:%s, it answered with a %s", srcHub.URL, srcRepo, srcTag, mediaType)
+	}
+	if isSchema1MediaType(mediaType) && !options.Artifact {
+		return source, copySchema1Image(srcHub, destHub, srcRepo, destRepo, destTag, content, options)
+	}
+	if isIndexMediaType(mediaType) && options.AllPlatforms {
+		return source, copyImageIndex(srcHub, destHub, srcRepo, srcTag, destRepo, destTag, mediaType, content, options)
+	}
+	if isIndexMediaType(mediaType) {
+		return source, fmt.Errorf("The manifest for %s/%s:%s is a %s, use --all-platforms to copy the image of every platform", srcHub.URL, srcRepo, srcTag, mediaType)
+	}
+	if isSchema1MediaType(mediaType) {
+		return source, fmt.Errorf("The manifest for %s/%s:%s is a %s, which can not be copied", srcHub.URL, srcRepo, srcTag, mediaType)
+	}
+
+	manifest, err := parseRawManifest(content)
+	if err != nil {
+		return source, fmt.Errorf("Failed to parse the manifest for %s/%s:%s. %v", srcHub.URL, srcRepo, srcTag, err)
+	}
+
+	if !options.Since.IsZero() && manifest.Config != nil {
+		created, err := imageCreated(srcHub, srcRepo, *manifest.Config)
+		if err != nil {
+			return source, fmt.Errorf("Failed to read when %s/%s:%s was created. %v", srcHub.URL, srcRepo, srcTag, err)
+		}
+		if isTooOld(srcHub, srcRepo, srcTag, created, options.Since) {
+			return source, nil
+		}
+	}
+
+	blobs := manifest.BlobDescriptors()
+	err = options.MediaTypes.Check(blobs)
+	if err != nil {
+		return source, err
+	}
+
+	if len(options.RewriteRefs) > 0 || options.Recompress != "" {
+		err = checkUnknownFields(content, options.Strict)
+		if err != nil {
+			return source, err
+		}
+	}
+
+	reportLayerDelta(destHub, destRepo, destTag, blobs)
+	if options.DryRun {
+		return source, reportDryRun(srcHub, destHub, srcRepo, destRepo, blobs)
+	}
+
+	var rewrittenConfig []byte
+	if len(options.RewriteRefs) > 0 && manifest.Config != nil {
+		content, rewrittenConfig, err = rewriteImageConfig(srcHub, srcRepo, content, *manifest.Config, options.RewriteRefs)
+		if err != nil {
+			return source, fmt.Errorf("Failed to rewrite the registry references in the config of %s/%s:%s. %v", srcHub.URL, srcRepo, srcTag, err)
+		}
+		if rewrittenConfig != nil {
+			// The source config, the first blob, is replaced by the new one
+			fmt.Println("Rewrote registry references in the image config")
+			blobs = blobs[1:]
+		}
+	}
+
+	recompressedLayers := []digest.Digest{}
+	if options.Recompress != "" {
+		var diffIDs []digest.Digest
+		if manifest.Config != nil {
+			diffIDs, err = imageDiffIDs(srcHub, srcRepo, *manifest.Config)
+			if err != nil {
+				return source, fmt.Errorf("Failed to read the layer digests from the config of %s/%s:%s. %v", srcHub.URL, srcRepo, srcTag, err)
+			}
+		}
+		content, mediaType, blobs, recompressedLayers, err = recompressLayers(srcHub, destHub, srcRepo, destRepo, content, mediaType, blobs, diffIDs, options)
+		if err != nil {
+			reportIncompleteCopy(destHub, destRepo, recompressedLayers, options)
+			return source, withExitCode(err, exitTransfer, fmt.Errorf("Failed to recompress the image layers. %v", err))
+		}
+	}
+
+	// The manifest may only be put once every blob it references is present
+	// in the destination, otherwise the tag can point at a broken image.
+	// pushImageBlobs is that barrier for the layers and the config alike.
+	uploadedBlobs, err := pushImageBlobs(srcHub, destHub, srcRepo, destRepo, blobs, rewrittenConfig, options)
+	uploadedBlobs = append(recompressedLayers, uploadedBlobs...)
+	if err != nil {
+		reportIncompleteCopy(destHub, destRepo, uploadedBlobs, options)
+		return source, err
+	}
+
+	err = putManifest(destHub, destRepo, destTag, mediaType, content)
+	if err != nil {
+		reportIncompleteCopy(destHub, destRepo, uploadedBlobs, options)
+		return source, manifestUploadError(destHub, destRepo, destTag, err)
+	}
+
+	if options.VerifyPull {
+		return source, verifyPull(destHub, destRepo, destTag, mediaType, content)
+	}
+	return source, nil
+}
+
+// checkUnknownFields reports the fields of a manifest that is about to be
+// rewritten which this tool doesn't know. They are kept as they are, which
+// --strict refuses as they can't be trusted to still hold after the rewrite.
+func checkUnknownFields(content []byte, strict bool) error {
+	unknown, err := unknownManifestFields(content)
+	if err != nil {
+		return fmt.Errorf("Failed to parse the manifest. %v", err)
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("The manifest has to be rewritten but has fields this tool doesn't know: %s", strings.Join(unknown, ", "))
+	}
+	fmt.Printf("The manifest has fields this tool doesn't know, they are kept unchanged: %s\n", strings.Join(unknown, ", "))
+	return nil
+}
+
+// sourceMediaTypes are the manifests accepted from the source.
+func sourceMediaTypes(options copyOptions) []string {
+	if options.ForceSchema1 {
+		return schema1ManifestMediaTypes
+	}
+	mediaTypes := imageManifestMediaTypes
+	if options.Artifact {
+		mediaTypes = artifactManifestMediaTypes
+	}
+	if options.AllPlatforms {
+		mediaTypes = append(append([]string{}, indexMediaTypes...), mediaTypes...)
+	}
+	return mediaTypes
+}
+
+// copyImageWithCheckpoint skips a copy the checkpoint records as completed
+// for the current source manifest, and records the copy once it completed.
+// Without a checkpoint it just copies the image.
+func copyImageWithCheckpoint(progress *checkpoint, srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, srcRef string, destRepo string, destRef string, options copyOptions) error {
+	if progress == nil || options.DryRun {
+		_, err := copyImageAndReferrers(srcHub, destHub, srcRepo, srcRef, destRepo, destRef, options)
+		return err
+	}
+
+	key := fmt.Sprintf("%s/%s:%s to %s/%s:%s", srcHub.URL, srcRepo, srcRef, destHub.URL, destRepo, destRef)
+	content, _, err := getManifest(srcHub, srcRepo, srcRef, sourceMediaTypes(options))
+	if err != nil {
+		// Let the copy report why the source can't be read
+		_, err = copyImageAndReferrers(srcHub, destHub, srcRepo, srcRef, destRepo, destRef, options)
+		return err
+	}
+
+	if progress.Completed(key, digest.FromBytes(content)) {
+		fmt.Printf("Skipped %s/%s:%s, it was already copied according to %s\n", srcHub.URL, srcRepo, srcRef, progress.Path)
+		return nil
+	}
+
+	// The tag may have moved since, what counts is the manifest copied
+	source, err := copyImageAndReferrers(srcHub, destHub, srcRepo, srcRef, destRepo, destRef, options)
+	if err != nil {
+		return err
+	}
+
+	err = progress.Record(key, source.Digest)
+	if err != nil {
+		fmt.Printf("Failed to update the checkpoint %s. %v\n", progress.Path, err)
+	}
+	return nil
+}
+
+// checkManifestDigests makes sure a manifest fetched by digest is the one
+// asked for, and that a destination referenced by digest can be pushed by
+// that digest, which only works for a manifest that is pushed unchanged.
+func checkManifestDigests(srcHub *registry.Registry, srcRepo string, srcRef string, destRef string, mediaType string, content []byte, options copyOptions) error {
+	contentDigest := digest.FromBytes(content)
+
+	srcDigest, err := digest.ParseDigest(srcRef)
+	if err == nil && srcDigest != contentDigest {
+		return fmt.Errorf("The manifest fetched for %s/%s@%s has the digest %s instead", srcHub.URL, srcRepo, srcDigest, contentDigest)
+	}
+
+	destDigest, err := digest.ParseDigest(destRef)
+	if err != nil {
+		return nil
+	}
+	if isSchema1MediaType(mediaType) && !options.Artifact {
+		return &exitError{Code: exitUsage, Err: fmt.Errorf("The schema1 manifest of %s/%s:%s is rewritten and pushed unsigned when copied, so it can not be pushed by the digest %s", srcHub.URL, srcRepo, srcRef, destDigest)}
+	}
+	if destDigest != contentDigest {
+		return &exitError{Code: exitUsage, Err: fmt.Errorf("The destination digest %s does not match the digest %s of the source manifest", destDigest, contentDigest)}
+	}
+	return nil
+}
+
+// platformImage is the image of one platform of a manifest list or OCI
+// index.
+type platformImage struct {
+	Descriptor descriptor
+	MediaType  string
+	Content    []byte
+	Blobs      []descriptor
+}
 
-	srcImageReader, err := srcHub.DownloadLayer(srcRepo, layerDigest)
+// copyImageIndex copies the image of every platform in a manifest list or OCI
+// index and then the index itself. The images are pushed by digest, and the
+// index is only published once all of them are in the destination, so a
+// failure never leaves a tag pointing at a subset of the platforms.
+func copyImageIndex(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, srcTag string, destRepo string, destTag string, mediaType string, content []byte, options copyOptions) error {
+	index, err := parseRawManifest(content)
 	if err != nil {
-		return fmt.Errorf("Failure while starting the download of an image layer. %v", err)
+		return fmt.Errorf("Failed to parse the manifest for %s/%s:%s. %v", srcHub.URL, srcRepo, srcTag, err)
 	}
 
-	_, err = io.Copy(file, srcImageReader)
-	if err != nil {
-		return fmt.Errorf("Failure while copying the image layer to a temp file. %v", err)
+	mediaTypes := imageManifestMediaTypes
+	if options.Artifact {
+		mediaTypes = artifactManifestMediaTypes
 	}
-	srcImageReader.Close()
-	file.Sync()
 
-	imageReadStream, err := os.Open(file.Name())
-	if err != nil {
-		return fmt.Errorf("Failed to open temporary image layer for uploading. %v", err)
+	// Fetch every image up front, so a platform missing from the source
+	// fails the copy before anything is uploaded
+	images := []platformImage{}
+	allBlobs := []descriptor{}
+	for _, entry := range index.Manifests {
+		imageContent, imageMediaType, err := getManifest(srcHub, srcRepo, entry.Digest.String(), mediaTypes)
+		if err != nil {
+			fetchErr := fmt.Errorf("Failed to fetch the image for platform %s of %s/%s:%s. %v", entry.Platform, srcHub.URL, srcRepo, srcTag, err)
+			if isManifestUnknown(err) {
+				return &exitError{Code: exitSourceNotFound, Err: fetchErr}
+			}
+			return withExitCode(err, exitTransfer, fetchErr)
+		}
+		if digest.FromBytes(imageContent) != entry.Digest {
+			return fmt.Errorf("The image for platform %s of %s/%s:%s does not match its digest %s", entry.Platform, srcHub.URL, srcRepo, srcTag, entry.Digest)
+		}
+		if isIndexMediaType(imageMediaType) || isSchema1MediaType(imageMediaType) {
+			return fmt.Errorf("The image for platform %s of %s/%s:%s is a %s, which can not be copied", entry.Platform, srcHub.URL, srcRepo, srcTag, imageMediaType)
+		}
+
+		manifest, err := parseRawManifest(imageContent)
+		if err != nil {
+			return fmt.Errorf("Failed to parse the image for platform %s of %s/%s:%s. %v", entry.Platform, srcHub.URL, srcRepo, srcTag, err)
+		}
+
+		blobs := manifest.BlobDescriptors()
+		err = options.MediaTypes.Check(blobs)
+		if err != nil {
+			return fmt.Errorf("The image for platform %s of %s/%s:%s can not be copied. %v", entry.Platform, srcHub.URL, srcRepo, srcTag, err)
+		}
+
+		images = append(images, platformImage{
+			Descriptor: entry,
+			MediaType:  imageMediaType,
+			Content:    imageContent,
+			Blobs:      blobs,
+		})
+		allBlobs = append(allBlobs, blobs...)
+	}
+
+	if options.DryRun {
+		fmt.Printf("Dry run: the index references %d platform(s)\n", len(images))
+		return reportDryRun(srcHub, destHub, srcRepo, destRepo, allBlobs)
+	}
+
+	uploadedBlobs := []digest.Digest{}
+	for _, image := range images {
+		fmt.Println("Copying the image for platform", image.Descriptor.Platform)
+
+		uploaded, err := migrateLayers(srcHub, destHub, srcRepo, destRepo, image.Blobs, options)
+		uploadedBlobs = append(uploadedBlobs, uploaded...)
+		if err != nil {
+			reportIncompleteCopy(destHub, destRepo, uploadedBlobs, options)
+			return withExitCode(err, exitTransfer, fmt.Errorf("Failed to migrate image layer for platform %s, the index was not published. %v", image.Descriptor.Platform, err))
+		}
+
+		err = putManifest(destHub, destRepo, image.Descriptor.Digest.String(), image.MediaType, image.Content)
+		if err != nil {
+			reportIncompleteCopy(destHub, destRepo, uploadedBlobs, options)
+			return withExitCode(err, exitTransfer, fmt.Errorf("Failed to upload the image for platform %s, the index was not published. %v", image.Descriptor.Platform, err))
+		}
 	}
-	err = destHub.UploadLayer(destRepo, layerDigest, imageReadStream)
-	imageReadStream.Close()
+
+	err = putManifest(destHub, destRepo, destTag, mediaType, content)
 	if err != nil {
-		return fmt.Errorf("Failure while uploading the image. %v", err)
+		reportIncompleteCopy(destHub, destRepo, uploadedBlobs, options)
+		return manifestUploadError(destHub, destRepo, destTag, err)
 	}
 
+	if options.VerifyPull {
+		return verifyPull(destHub, destRepo, destTag, mediaType, content)
+	}
 	return nil
 }
 
-func migrateLayer(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, layer schema1.FSLayer) error {
-	fmt.Println("Checking if manifest layer exists in destination registery")
+// isTooOld tells whether an image was created before --since. An image that
+// doesn't record when it was created is copied.
+func isTooOld(srcHub *registry.Registry, srcRepo string, srcRef string, created time.Time, since time.Time) bool {
+	if created.IsZero() {
+		fmt.Printf("%s/%s:%s does not record when it was created, copying it anyway\n", srcHub.URL, srcRepo, srcRef)
+		return false
+	}
+	if created.Before(since) {
+		fmt.Printf("Skipped %s/%s:%s, too old: it was created at %s\n", srcHub.URL, srcRepo, srcRef, created.Format(time.RFC3339))
+		return true
+	}
+	return false
+}
 
-	layerDigest := layer.BlobSum
-	hasLayer, err := destHub.HasLayer(destRepo, layerDigest)
+// copySchema1Image copies an image with a schema1 manifest. The repository
+// name is part of the manifest so it is rewritten for the destination, which
+// invalidates the signatures, so the manifest is pushed unsigned.
+func copySchema1Image(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, destTag string, content []byte, options copyOptions) error {
+	manifest := &schema1.SignedManifest{}
+	err := manifest.UnmarshalJSON(content)
 	if err != nil {
-		return fmt.Errorf("Failure while checking if the destination registry contained an image layer. %v", err)
+		return fmt.Errorf("Failed to parse the schema1 manifest of %s/%s. %v", srcHub.URL, srcRepo, err)
 	}
 
-	if !hasLayer {
-		fmt.Println("Need to upload layer", layerDigest, "to the destination")
-		tempFile, err := ioutil.TempFile("", "docker-image")
+	if !options.Since.IsZero() {
+		created, err := schema1Created(manifest)
 		if err != nil {
-			return fmt.Errorf("Failure while creating temporary file for an image layer download. %v", err)
+			return fmt.Errorf("Failed to read when %s/%s:%s was created. %v", srcHub.URL, srcRepo, manifest.Tag, err)
 		}
-
-		err = moveLayerUsingFile(srcHub, destHub, srcRepo, destRepo, layer, tempFile)
-		removeErr := os.Remove(tempFile.Name())
-		if removeErr != nil {
-			// Print the error but don't fail the whole migration just because of a leaked temp file
-			fmt.Printf("Failed to remove image layer temp file %s. %v", tempFile.Name(), removeErr)
+		if isTooOld(srcHub, srcRepo, manifest.Tag, created, options.Since) {
+			return nil
 		}
+	}
 
+	if options.Recompress != "" {
+		fmt.Println("schema1 manifests can only reference gzip layers, copying the layers without converting them")
+	}
+
+	// schema1 manifests are always rewritten to embed the destination name
+	err = checkUnknownFields(manifest.Canonical, options.Strict)
+	if err != nil {
 		return err
-	} else {
-		fmt.Println("Layer already exists in the destination")
-		return nil
 	}
+
+	layers := []descriptor{}
+	for _, layer := range manifest.FSLayers {
+		layers = append(layers, descriptor{Digest: layer.BlobSum})
+	}
+
+	err = options.MediaTypes.Check(layers)
+	if err != nil {
+		return err
+	}
+
+	reportLayerDelta(destHub, destRepo, destTag, layers)
+	if options.DryRun {
+		return reportDryRun(srcHub, destHub, srcRepo, destRepo, layers)
+	}
+
+	uploadedLayers, err := migrateLayers(srcHub, destHub, srcRepo, destRepo, layers, options)
+	if err != nil {
+		reportIncompleteCopy(destHub, destRepo, uploadedLayers, options)
+		return withExitCode(err, exitTransfer, fmt.Errorf("Failed to migrate image layer. %v", err))
+	}
+
+	destContent, err := renameSchema1Manifest(manifest, destRepo)
+	if err != nil {
+		reportIncompleteCopy(destHub, destRepo, uploadedLayers, options)
+		return fmt.Errorf("Failed to rename the schema1 manifest of %s/%s. %v", srcHub.URL, srcRepo, err)
+	}
+
+	err = putManifest(destHub, destRepo, destTag, schema1.MediaTypeManifest, destContent)
+	if err != nil {
+		reportIncompleteCopy(destHub, destRepo, uploadedLayers, options)
+		return manifestUploadError(destHub, destRepo, destTag, err)
+	}
+
+	if options.VerifyPull {
+		return verifyPull(destHub, destRepo, destTag, schema1.MediaTypeManifest, destContent)
+	}
+	return nil
+}
+
+// readTags reads a newline separated list of tags, skipping empty lines and
+// # comments.
+func readTags(reader io.Reader) ([]string, error) {
+	tags := []string{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		tag := strings.TrimSpace(scanner.Text())
+		if tag == "" || strings.HasPrefix(tag, "#") {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags, scanner.Err()
 }
 
 type RepositoryArguments struct {
+	Prefix      string
+	Description string
 	RegistryURL *string
 	Repository  *string
 	Tag         *string
+	Digest      *string
+	Username    *string
+	Password    *string
+	Anonymous   *bool
+	Auth        *string
+	UserAgent   *string
+	Headers     *map[string]string
+	MaxConns    *int
+	ClientCert  *string
+	ClientKey   *string
+	OCIDir      *string
+	CredHelper  string
+	Debug       bool
+	Progress    bool
+	Deadline    context.Context
 }
 
 func buildRegistryArguments(argPrefix string, argDescription string) RepositoryArguments {
@@ -107,66 +987,402 @@ func buildRegistryArguments(argPrefix string, argDescription string) RepositoryA
 	tagDescription := fmt.Sprintf("Name of the %s tag", argDescription)
 	tagArg := kingpin.Flag(tagName, tagDescription).String()
 
+	digestName := fmt.Sprintf("%s-digest", argPrefix)
+	digestDescription := fmt.Sprintf("Digest of the %s image, instead of a tag", argDescription)
+	digestArg := kingpin.Flag(digestName, digestDescription).String()
+
+	usernameName := fmt.Sprintf("%s-username", argPrefix)
+	usernameDescription := fmt.Sprintf("Username for the %s registry", argDescription)
+	usernameArg := kingpin.Flag(usernameName, usernameDescription).String()
+
+	passwordName := fmt.Sprintf("%s-password", argPrefix)
+	passwordDescription := fmt.Sprintf("Password for the %s registry", argDescription)
+	passwordArg := kingpin.Flag(passwordName, passwordDescription).String()
+
+	anonymousName := fmt.Sprintf("%s-anonymous", argPrefix)
+	anonymousDescription := fmt.Sprintf("Access the %s registry anonymously, without any credentials", argDescription)
+	anonymousArg := kingpin.Flag(anonymousName, anonymousDescription).Bool()
+
+	authName := fmt.Sprintf("%s-auth", argPrefix)
+	authDescription := fmt.Sprintf("How to find the credentials for the %s registry, auto picks the provider by its URL", argDescription)
+	authArg := kingpin.Flag(authName, authDescription).Default("auto").Enum(authProviderNames()...)
+
+	userAgentName := fmt.Sprintf("%s-user-agent", argPrefix)
+	userAgentDescription := fmt.Sprintf("User-Agent sent to the %s registry. Overrides --user-agent", argDescription)
+	userAgentArg := kingpin.Flag(userAgentName, userAgentDescription).String()
+
+	headerName := fmt.Sprintf("%s-header", argPrefix)
+	headerDescription := fmt.Sprintf("Extra header sent to the %s registry as name=value. Overrides --header with the same name", argDescription)
+	headerArg := kingpin.Flag(headerName, headerDescription).PlaceHolder("NAME=VALUE").StringMap()
+
+	maxConnsName := fmt.Sprintf("%s-max-connections", argPrefix)
+	maxConnsDescription := fmt.Sprintf("Maximum number of concurrent requests to the %s registry. Overrides --max-connections-per-registry", argDescription)
+	maxConnsArg := kingpin.Flag(maxConnsName, maxConnsDescription).Int()
+
+	clientCertName := fmt.Sprintf("%s-client-cert", argPrefix)
+	clientCertDescription := fmt.Sprintf("PEM file with the client certificate for a %s registry that requires mutual TLS", argDescription)
+	clientCertArg := kingpin.Flag(clientCertName, clientCertDescription).String()
+
+	clientKeyName := fmt.Sprintf("%s-client-key", argPrefix)
+	clientKeyDescription := fmt.Sprintf("PEM file with the key of the %s client certificate, when it is not in the certificate file", argDescription)
+	clientKeyArg := kingpin.Flag(clientKeyName, clientKeyDescription).String()
+
+	ociDirName := fmt.Sprintf("%s-oci-dir", argPrefix)
+	ociDirDescription := fmt.Sprintf("Use a directory in the OCI image layout as the %s, the same as an oci:// reference", argDescription)
+	ociDirArg := kingpin.Flag(ociDirName, ociDirDescription).String()
+
 	return RepositoryArguments{
+		Prefix:      argPrefix,
+		Description: argDescription,
 		RegistryURL: registryURLArg,
 		Repository:  repositoryArg,
 		Tag:         tagArg,
+		Digest:      digestArg,
+		Username:    usernameArg,
+		Password:    passwordArg,
+		Anonymous:   anonymousArg,
+		Auth:        authArg,
+		UserAgent:   userAgentArg,
+		Headers:     headerArg,
+		MaxConns:    maxConnsArg,
+		ClientCert:  clientCertArg,
+		ClientKey:   clientKeyArg,
+		OCIDir:      ociDirArg,
 	}
 }
 
 func connectToRegistry(args RepositoryArguments) (*registry.Registry, error) {
 	origUrl := *args.RegistryURL
-	url := origUrl
-	username := ""
-	password := ""
+	if isDirTransport(origUrl) || isOCILayoutTransport(origUrl) {
+		open := openDirectory
+		if isOCILayoutTransport(origUrl) {
+			open = openOCILayout
+		}
+		hub, err := open(origUrl)
+		if err == nil && args.Deadline != nil {
+			hub.Client.Transport = &deadlineTransport{Transport: hub.Client.Transport, Context: args.Deadline}
+		}
+		return hub, err
+	}
 
-	r, _ := regexp.Compile(`(?P<account_id>[0-9]{12})\.dkr\.ecr\.(?P<region>[\w\d-]+)\.amazonaws\.com`)
-	r2 := r.FindAllStringSubmatch(url, -1)
+	url, username, password, err := registryCredentials(args)
+	if err != nil {
+		return nil, err
+	}
 
-	if r2 != nil {
-		registryId := r2[0][1]
-		region := r2[0][2]
+	if *args.Anonymous {
+		// Without credentials the token transport requests an anonymous token
+		// whenever the registry answers with a bearer challenge, which is how
+		// public images on Docker Hub and similar registries are pulled.
+		fmt.Println("Accessing", origUrl, "anonymously")
+	}
+	return openRegistry(args, url, username, password)
+}
 
-		sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+// registryCredentials finds the credentials for a registry, together with the
+// URL to use them with.
+func registryCredentials(args RepositoryArguments) (string, string, string, error) {
+	url := *args.RegistryURL
+	username := *args.Username
+	password := *args.Password
 
-		if err != nil {
-			return nil, fmt.Errorf("Failed to create new AWS SDK session. %v", err)
+	if *args.Anonymous {
+		if username != "" || password != "" {
+			return "", "", "", &exitError{Code: exitUsage, Err: fmt.Errorf("Credentials can not be combined with anonymous access to %s", url)}
+		}
+		return url, "", "", nil
+	}
+
+	provider, err := selectAuthProvider(*args.Auth, url, username, password, args.CredHelper, args.Deadline)
+	if err != nil {
+		return "", "", "", &exitError{Code: exitUsage, Err: err}
+	}
+	username, password, url, err = provider.Credentials(url)
+	return url, username, password, err
+}
+
+func openRegistry(args RepositoryArguments, url string, username string, password string) (*registry.Registry, error) {
+	origUrl := *args.RegistryURL
+	url = registryBaseURL(url)
+
+	transport, err := baseTransport(args)
+	if err != nil {
+		return nil, &exitError{Code: exitUsage, Err: err}
+	}
+	if args.Debug {
+		transport = &debugTransport{Transport: transport, Headers: *args.Headers}
+	}
+	if args.Progress {
+		transport = &progressTransport{Transport: transport, Tracker: transferProgress}
+	}
+	if args.Deadline != nil {
+		transport = &deadlineTransport{Transport: transport, Context: args.Deadline}
+	}
+	transport = &locationTransport{Transport: transport}
+	if *args.MaxConns > 0 {
+		transport = &limitTransport{
+			Transport: transport,
+			Semaphore: make(chan struct{}, *args.MaxConns),
+		}
+	}
+	transport = &headerTransport{
+		Transport: transport,
+		UserAgent: *args.UserAgent,
+		Headers:   *args.Headers,
+	}
+	registry := &registry.Registry{
+		URL: url,
+		Client: &http.Client{
+			Transport: registry.WrapTransport(transport, url, username, password),
+		},
+		Logf: registry.Log,
+	}
+
+	err = registry.Ping()
+	if err != nil {
+		return nil, withExitCode(err, exitFailure, fmt.Errorf("Failed to ping registry %s as a connection test. %v", origUrl, err))
+	}
+
+	return registry, nil
+}
+
+// parseSince accepts a point in time either as a date, with or without the
+// time of day, or as a duration counting back from now.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	duration, err := time.ParseDuration(value)
+	if err == nil {
+		return now.Add(-duration), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		since, err := time.Parse(layout, value)
+		if err == nil {
+			return since, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid --since %s, expected a date like 2017-03-01 or a duration like 72h", value)
+}
+
+// registryBaseURL is the URL the /v2/ API paths are appended to. It keeps any
+// path prefix the registry is hosted under, as with Artifactory or Harbor
+// behind a proxy, and drops a trailing /v2 copied from API documentation.
+func registryBaseURL(url string) string {
+	url = strings.TrimRight(url, "/")
+	url = strings.TrimSuffix(url, "/v2")
+	return url
+}
+
+// Reference returns what to ask the registry for, the digest if there is one
+// and the tag otherwise.
+func (args RepositoryArguments) Reference() string {
+	if *args.Digest != "" {
+		return *args.Digest
+	}
+	return *args.Tag
+}
+
+// ImageName formats the image as registry/repository:tag, or with @digest.
+func (args RepositoryArguments) ImageName() string {
+	if *args.Digest != "" {
+		return fmt.Sprintf("%s/%s@%s", *args.RegistryURL, *args.Repository, *args.Digest)
+	}
+	return fmt.Sprintf("%s/%s:%s", *args.RegistryURL, *args.Repository, *args.Tag)
+}
+
+// resolvedImageName formats the image a copy actually reads or writes, with
+// the base URL the registry was reached at and a transport prefix. reference
+// is either a tag or a digest.
+func resolvedImageName(hubURL string, repository string, reference string) string {
+	separator := ":"
+	if strings.Contains(reference, ":") {
+		separator = "@"
+	}
+	if isDirTransport(hubURL) {
+		if separator == "@" {
+			return hubURL + separator + reference
 		}
-		svc := ecr.New(sess)
-		params := &ecr.GetAuthorizationTokenInput{
-			RegistryIds: []*string{
-				aws.String(registryId), // Required
-			},
+		return hubURL
+	}
+	if isOCILayoutTransport(hubURL) {
+		return hubURL + separator + reference
+	}
+	return fmt.Sprintf("%s%s/%s%s%s", dockerTransportPrefix, strings.TrimPrefix(hubURL, "https://"), repository, separator, reference)
+}
+
+// resolveImageArguments settles which image one side of the copy refers to.
+// Every part is taken from the first of these that provides it:
+//
+//  1. the flags of that side, like --src-repo, --src-tag or --src-digest
+//  2. the full image reference given as a positional argument, or as
+//     --src-oci-dir or --dest-oci-dir
+//  3. the flags shared by both sides, --repo and --tag
+//  4. defaultDigest, which lets the destination keep a source pinned by digest
+//  5. the latest tag, when neither a tag nor a digest was given
+//
+// A tag and a digest always travel together, so a digest from a higher level
+// is never mixed with a tag from a lower one. Giving both a tag and a digest
+// with the flags of the same side is a contradiction and an error.
+func resolveImageArguments(args RepositoryArguments, ref string, sharedRepo string, sharedTag string, defaultDigest string) error {
+	if *args.Tag != "" && *args.Digest != "" {
+		return fmt.Errorf("--%s-tag and --%s-digest can not be combined", args.Prefix, args.Prefix)
+	}
+	if *args.Digest != "" {
+		parsedDigest, err := digest.ParseDigest(*args.Digest)
+		if err != nil {
+			return fmt.Errorf("Invalid --%s-digest %s. %v", args.Prefix, *args.Digest, err)
 		}
+		*args.Digest = parsedDigest.String()
+	}
 
-		resp, err := svc.GetAuthorizationToken(params)
+	if *args.OCIDir != "" {
+		ref = ociTransportPrefix + *args.OCIDir
+	}
+	if ref != "" {
+		parsed, err := parseImageReference(ref)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to get ECR authorization token for registry %s. %v", registryId, err)
+			return fmt.Errorf("Failed to parse the %s image reference. %v", args.Description, err)
+		}
+
+		if *args.RegistryURL == "" {
+			*args.RegistryURL = parsed.RegistryURL
 		}
+		if *args.Repository == "" {
+			*args.Repository = parsed.Repository
+		}
+		if *args.Tag == "" && *args.Digest == "" {
+			*args.Tag = parsed.Tag
+			*args.Digest = parsed.Digest
+		}
+	}
+
+	if *args.Repository == "" {
+		*args.Repository = sharedRepo
+	}
+	if *args.Tag == "" && *args.Digest == "" {
+		*args.Tag = sharedTag
+	}
+	if *args.Tag == "" && *args.Digest == "" {
+		*args.Digest = defaultDigest
+	}
+	if *args.Tag == "" && *args.Digest == "" {
+		*args.Tag = "latest"
+	}
 
-		decoded, err := base64.StdEncoding.DecodeString(*resp.AuthorizationData[0].AuthorizationToken)
+	if *args.Repository == "" {
+		return fmt.Errorf("A %s repository name is required either with --%s-repo or --repo", args.Description, args.Prefix)
+	}
+	return nil
+}
+
+// resolveCopyArguments settles the images on both sides of a copy, the
+// source first as the destination falls back to it. readOnly skips the
+// destination of the commands that have none.
+func resolveCopyArguments(srcArgs RepositoryArguments, destArgs RepositoryArguments, srcRef string, destRef string, sharedRepo string, sharedTag string, destNamespace string, readOnly bool) error {
+	err := resolveImageArguments(srcArgs, srcRef, sharedRepo, sharedTag, "")
+	if err != nil || readOnly {
+		return err
+	}
+
+	// A source pinned by digest alone is pushed by the same digest, unless
+	// the destination names a tag or digest of its own
+	defaultDigest := ""
+	if *srcArgs.Tag == "" {
+		defaultDigest = *srcArgs.Digest
+	}
+	destRepo := sharedRepo
+	if destNamespace != "" {
+		namespace := strings.Trim(destNamespace, "/")
+		if namespace == "" {
+			return fmt.Errorf("--dest-namespace %s names no namespace", destNamespace)
+		}
+		err = validateRepositoryName(namespace)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to decode base64 encoded authorization data for ECR registry %s. %v", registryId, err)
+			return fmt.Errorf("Invalid --dest-namespace %s. %v", destNamespace, err)
 		}
+		destRepo = namespace + "/" + path.Base(*srcArgs.Repository)
+	}
+	return resolveImageArguments(destArgs, destRef, destRepo, sharedTag, defaultDigest)
+}
+
+// mergeHeaders combines the headers shared by both registries with the ones
+// given for a single side, where the latter win.
+func mergeHeaders(shared map[string]string, overrides map[string]string) *map[string]string {
+	merged := map[string]string{}
+	for name, value := range shared {
+		merged[name] = value
+	}
+	for name, value := range overrides {
+		merged[name] = value
+	}
+	return &merged
+}
 
-		parts := strings.Split(string(decoded), ":")
+// normalizeRegistryURL reduces a registry URL to its host and path so that
+// equivalent spellings like "https://registry/" and "registry" compare equal.
+func normalizeRegistryURL(registryURL string) string {
+	normalized := strings.ToLower(strings.TrimSpace(registryURL))
+	normalized = strings.TrimPrefix(normalized, dockerTransportPrefix)
+	normalized = strings.TrimPrefix(normalized, "https://")
+	normalized = strings.TrimPrefix(normalized, "http://")
+	return strings.TrimRight(normalized, "/")
+}
+
+func isSameImage(srcArgs RepositoryArguments, destArgs RepositoryArguments) bool {
+	return normalizeRegistryURL(*srcArgs.RegistryURL) == normalizeRegistryURL(*destArgs.RegistryURL) &&
+		*srcArgs.Repository == *destArgs.Repository &&
+		srcArgs.Reference() == destArgs.Reference()
+}
 
-		url = *resp.AuthorizationData[0].ProxyEndpoint
-		username = parts[0]
-		password = parts[1]
+// httpStatusError digs the registry response out of an error returned by the
+// registry client, or returns nil when the request failed another way.
+func httpStatusError(err error) *registry.HttpStatusError {
+	if urlErr, ok := err.(*neturl.Error); ok {
+		err = urlErr.Err
 	}
+	httpErr, _ := err.(*registry.HttpStatusError)
+	return httpErr
+}
 
-	registry, err := registry.New(url, username, password)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create registry connection for %s. %v", origUrl, err)
+func isManifestUnknown(err error) bool {
+	httpErr := httpStatusError(err)
+	if httpErr == nil {
+		return false
 	}
+	return httpErr.Response.StatusCode == http.StatusNotFound || strings.Contains(string(httpErr.Body), "MANIFEST_UNKNOWN")
+}
 
-	err = registry.Ping()
-	if err != nil {
-		return nil, fmt.Errorf("Failed to ping registry %s as a connection test. %v", origUrl, err)
+// deadlinePassed tells whether --deadline passed, which is then what made
+// the copy fail.
+func deadlinePassed(deadline context.Context) bool {
+	return deadline != nil && deadline.Err() == context.DeadlineExceeded
+}
+
+// reportDeadline explains a failure caused by --deadline passing, with how
+// far the copy got and the tags it never attempted, and sets its exit code.
+// Temp files are already gone by then, each one is removed when the layer
+// using it fails.
+func reportDeadline(deadline context.Context, limit time.Duration, tally *copyTally, unattempted []string, exitCode *int) {
+	if !deadlinePassed(deadline) {
+		return
+	}
+	fmt.Printf("\nThe --deadline of %v passed before the copy completed, %v", limit, tally)
+	if len(unattempted) > 0 {
+		fmt.Printf("\nTags not attempted: %s", strings.Join(unattempted, ", "))
 	}
+	*exitCode = exitDeadline
+}
 
-	return registry, nil
+// isImmutableTagError recognizes a registry refusing to overwrite a tag. ECR
+// answers with TAG_INVALID and a message about the immutable repository,
+// Harbor and others mention immutability in their message.
+func isImmutableTagError(err error) bool {
+	httpErr := httpStatusError(err)
+	if httpErr == nil {
+		return false
+	}
+	body := strings.ToLower(string(httpErr.Body))
+	return strings.Contains(body, "immutable") ||
+		strings.Contains(body, "imagetagalreadyexists") ||
+		(strings.Contains(body, "tag_invalid") && strings.Contains(body, "already exists"))
 }
 
 func main() {
@@ -178,75 +1394,370 @@ func main() {
 	srcArgs := buildRegistryArguments("src", "source")
 	destArgs := buildRegistryArguments("dest", "destination")
 	repoArg := kingpin.Flag("repo", "The repository in the source and the destination. Values provided by --src-repo or --dest-tag will override this value").String()
-	tagArg := kingpin.Flag("tag", "The tag name in the source and the destination. Values provided by --src-tag or --dest-tag will override this value").Default("latest").String()
-	kingpin.Parse()
+	destNamespaceArg := kingpin.Flag("dest-namespace", "Without a destination repository, copy to the last path component of the source repository under this namespace, like mirror/nginx for library/nginx").String()
+	tagArg := kingpin.Flag("tag", "The tag name in the source and the destination, latest when no tag is given anywhere. Values provided by --src-tag or --dest-tag will override this value").String()
+	retryOnManifestUnknownArg := kingpin.Flag("retry-on-manifest-unknown", "Retry fetching the source manifest when the source registry does not know it yet").Bool()
+	manifestRetriesArg := kingpin.Flag("manifest-retries", "How many times to retry fetching an unknown source manifest").Default("3").Int()
+	manifestRetryDelayArg := kingpin.Flag("manifest-retry-delay", "Base delay between retries of an unknown source manifest, doubled on every retry and randomized").Default("5s").Duration()
+	layerRetriesArg := kingpin.Flag("layer-retries", "How many times to retry checking, downloading or uploading a layer after the registry failed with a 429 or 5xx status or the connection broke").Default("3").Int()
+	layerRetryDelayArg := kingpin.Flag("layer-retry-delay", "Base delay between retries of a layer, doubled on every retry and randomized").Default("1s").Duration()
+	retryMaxDelayArg := kingpin.Flag("retry-max-delay", "Upper bound of the delay between two retries").Default("1m").Duration()
+	forceArg := kingpin.Flag("force", "Copy even when the source and the destination refer to the same image").Bool()
+	cleanupOnFailureArg := kingpin.Flag("cleanup-on-failure", "Try to delete the layers uploaded to the destination when the image can not be published").Bool()
+	verifyExistingArg := kingpin.Flag("verify-existing", "Verify layers that already exist in the destination against the source before trusting them").Bool()
+	overwriteExistingLayersArg := kingpin.Flag("overwrite-existing-layers", "Upload every layer again, even when it already exists in the destination").Bool()
+	streamLayersArg := kingpin.Flag("stream-layers", "Upload layers while they are downloaded instead of going through a temp file").Bool()
+	downloadSegmentsArg := kingpin.Flag("download-segments", "Download each layer as this many parallel byte ranges when the source registry supports it").Default("1").Int()
+	artifactArg := kingpin.Flag("artifact", "Copy an OCI artifact or any other manifest of plain blobs verbatim, without treating it as a container image").Bool()
+	forceSchema1Arg := kingpin.Flag("force-schema1", "Always fetch and push the schema1 manifest of the image, for destinations that only accept schema1").Bool()
+	continueOnMissingLayerArg := kingpin.Flag("continue-on-layer-missing-in-source", "When a layer is missing in the source, copy the other layers anyway and list every missing one, for triage. The manifest is never pushed then").Bool()
+	verifyPullArg := kingpin.Flag("verify-pull", "After the copy, read the manifest back from the destination and check that every blob it references is there with the right size").Bool()
+	copyReferrersArg := kingpin.Flag("copy-referrers", "Also copy the artifacts referring to the image, like signatures, SBOMs and attestations, using the OCI referrers API").Bool()
+	strictArg := kingpin.Flag("strict", "Refuse to rewrite a manifest with fields this tool doesn't know, like schema1 manifests or with --rewrite-refs and --recompress").Bool()
+	allPlatformsArg := kingpin.Flag("all-platforms", "Copy a manifest list or OCI index with the image of every platform, and fail without publishing it when any of them can not be copied").Bool()
+	rewriteRefsArg := kingpin.Flag("rewrite-refs", "Replace a registry reference in the image config, like a label naming the source registry, as old=new. Changes the digest of the config and the manifest. Can be repeated").PlaceHolder("OLD=NEW").StringMap()
+	recompressArg := kingpin.Flag("recompress", "Convert the layers to zstd, gzip or uncompressed, which changes the digest of the layers and the manifest. For zstd, schema2 manifests are converted to OCI ones").Enum(recompressionZstd, recompressionGzip, recompressionUncompressed)
+	sinceArg := kingpin.Flag("since", "Skip images created before this date, or longer ago than this duration, like 2017-03-01 or 72h").String()
+	keepLastArg := kingpin.Flag("keep-last", "After copying, delete all but this many of the newest tags in the destination repository, ordered by semantic version or else by creation time. Combine with --dry-run to only list them").Int()
+	dryRunArg := kingpin.Flag("dry-run", "Only report which layers would be copied and how many bytes that is, without copying anything").Bool()
+	tempPrefixArg := kingpin.Flag("temp-prefix", "Prefix of the temp files layers are downloaded to").Default("docker-image").String()
+	memoryThresholdArg := kingpin.Flag("memory-threshold", "Keep layers up to this size in memory instead of a temp file, 0 to always use a temp file").Default("1MB").Bytes()
+	maxTempBytesArg := kingpin.Flag("max-temp-bytes", "Most disk space the temp files may take together, like 2GB. Layers larger than the limit and layers of unknown size are streamed instead, 0 for no limit").Default("0").Bytes()
+	allowMediaTypeArg := kingpin.Flag("allow-media-type", "Only copy images whose blobs all have one of these media types, patterns like application/vnd.oci.image.layer.* are allowed. Can be repeated").Strings()
+	denyMediaTypeArg := kingpin.Flag("deny-media-type", "Refuse to copy images with a blob of one of these media types, patterns are allowed. Can be repeated").Strings()
+	printResolvedArg := kingpin.Flag("print-resolved", "Print the source and destination images after all arguments and defaults were applied").Bool()
+	checkDestinationArg := kingpin.Flag("check-destination", "Check that the destination repository can be pushed to before copying anything, use --no-check-destination to skip the check").Default("true").Bool()
+	mountLayersArg := kingpin.Flag("mount-layers", "Mount layers from the source repository when both are in the same registry, use --no-mount-layers to always upload them").Default("true").Bool()
+	userAgentArg := kingpin.Flag("user-agent", "User-Agent sent to the source and the destination registries").String()
+	headerArg := kingpin.Flag("header", "Extra header sent to the source and the destination registries as name=value. Can be repeated").PlaceHolder("NAME=VALUE").StringMap()
+	maxConnsArg := kingpin.Flag("max-connections-per-registry", "Maximum number of concurrent requests to the source and to the destination, each on its own, 0 for no limit").Int()
+	credHelperArg := kingpin.Flag("cred-helper", "Command asked for the credentials of a registry no other auth provider handles. It gets the registry URL on stdin and answers with JSON like {\"username\": \"...\", \"password\": \"...\"}").String()
+	progressArg := kingpin.Flag("progress", "Report the progress of the layer downloads, as a line updated in place on a terminal and as a log line every 10 seconds otherwise").Bool()
+	debugArg := kingpin.Flag("debug", "Log every request sent to the registries and their responses, with credentials redacted").Bool()
+	deadlineArg := kingpin.Flag("deadline", "Abort the whole run once it took longer than this, like 30m, 0 for no limit").Default("0").Duration()
+	resumeArg := kingpin.Flag("resume", "Record every completed copy in this checkpoint file and skip the copies it already records for the same source image, to resume an interrupted batch").PlaceHolder("CHECKPOINT").String()
+	tagsFromStdinArg := kingpin.Flag("tags-from-stdin", "Copy every tag listed on stdin, one per line, instead of a single tag").Bool()
+	srcRefDescription := "Full reference of the source image, like registry.example.com/team/app:1.2.3. Values provided by --src-url, --src-repo or --src-tag will override it"
+	destRefDescription := "Full reference of the destination image, like registry.example.com/mirror/app:1.2.3. Values provided by --dest-url, --dest-repo or --dest-tag will override it"
+	copyCmd := kingpin.Command("copy", "Copy an image from the source to the destination, the default command").Default()
+	srcRefArg := copyCmd.Arg("source", srcRefDescription).String()
+	destRefArg := copyCmd.Arg("destination", destRefDescription).String()
+	doctorCmd := kingpin.Command("doctor", "Check step by step that the source and the destination can be accessed, without copying anything")
+	doctorSrcRefArg := doctorCmd.Arg("source", srcRefDescription).String()
+	doctorDestRefArg := doctorCmd.Arg("destination", destRefDescription).String()
+	tagsCmd := kingpin.Command("tags", "List the tags of the source repository")
+	tagsSrcRefArg := tagsCmd.Arg("source", srcRefDescription).String()
+	tagsFormatArg := outputFormatFlag(tagsCmd)
+	inspectCmd := kingpin.Command("inspect", "Summarize the manifest of the source image, without copying anything")
+	inspectSrcRefArg := inspectCmd.Arg("source", srcRefDescription).String()
+	inspectFormatArg := outputFormatFlag(inspectCmd)
+	kingpin.CommandLine.Terminate(func(code int) {
+		if code != 0 {
+			code = exitUsage
+		}
+		os.Exit(code)
+	})
+	command := kingpin.Parse()
 
-	if *srcArgs.Repository == "" {
-		srcArgs.Repository = repoArg
+	srcRef, destRef := *srcRefArg, *destRefArg
+	switch command {
+	case doctorCmd.FullCommand():
+		srcRef, destRef = *doctorSrcRefArg, *doctorDestRefArg
+	case tagsCmd.FullCommand():
+		srcRef = *tagsSrcRefArg
+	case inspectCmd.FullCommand():
+		srcRef = *inspectSrcRefArg
 	}
-	if *destArgs.Repository == "" {
-		destArgs.Repository = repoArg
+
+	// The read-only commands have no destination
+	readOnly := command == tagsCmd.FullCommand() || command == inspectCmd.FullCommand()
+	err := resolveCopyArguments(srcArgs, destArgs, srcRef, destRef, *repoArg, *tagArg, *destNamespaceArg, readOnly)
+	if err != nil {
+		fmt.Print(err)
+		exitCode = exitUsage
+		return
 	}
 
-	if *srcArgs.Tag == "" {
-		srcArgs.Tag = tagArg
+	if *srcArgs.UserAgent == "" {
+		srcArgs.UserAgent = userAgentArg
+	}
+	if *destArgs.UserAgent == "" {
+		destArgs.UserAgent = userAgentArg
+	}
+
+	if *srcArgs.MaxConns == 0 {
+		srcArgs.MaxConns = maxConnsArg
+	}
+	if *destArgs.MaxConns == 0 {
+		destArgs.MaxConns = maxConnsArg
 	}
-	if *destArgs.Tag == "" {
-		destArgs.Tag = tagArg
+
+	srcArgs.Headers = mergeHeaders(*headerArg, *srcArgs.Headers)
+	destArgs.Headers = mergeHeaders(*headerArg, *destArgs.Headers)
+
+	srcArgs.Debug = *debugArg
+	destArgs.Debug = *debugArg
+
+	srcArgs.CredHelper = *credHelperArg
+	// Only the downloads are counted, every layer is downloaded before or
+	// while it is uploaded
+	srcArgs.Progress = *progressArg
+	destArgs.CredHelper = *credHelperArg
+
+	if command == doctorCmd.FullCommand() {
+		if !runDoctor(srcArgs, destArgs, *tempPrefixArg) {
+			exitCode = exitFailure
+		}
+		return
+	}
+
+	if readOnly {
+		if command == tagsCmd.FullCommand() {
+			err = runTags(srcArgs, outputFormat(*tagsFormatArg, outputPlain))
+		} else {
+			err = runInspect(srcArgs, outputFormat(*inspectFormatArg, outputJSON))
+		}
+		if err != nil {
+			fmt.Print(err)
+			exitCode = exitCodeFor(err)
+		}
+		return
 	}
 
-	if *srcArgs.Repository == "" {
-		fmt.Printf("A source repository name is required either with --src-repo or --repo")
-		exitCode = -1
+	if *streamLayersArg && *downloadSegmentsArg > 1 {
+		fmt.Printf("--stream-layers can not be combined with --download-segments")
+		exitCode = exitUsage
+		return
+	}
+	var since time.Time
+	if *sinceArg != "" {
+		since, err = parseSince(*sinceArg, time.Now())
+		if err != nil {
+			fmt.Print(err)
+			exitCode = exitUsage
+			return
+		}
+	}
+	if *forceSchema1Arg && (*artifactArg || *allPlatformsArg || len(*rewriteRefsArg) > 0 || *recompressArg != "") {
+		fmt.Printf("--force-schema1 can not be combined with --artifact, --all-platforms, --rewrite-refs or --recompress")
+		exitCode = exitUsage
+		return
+	}
+	if *copyReferrersArg && (*forceSchema1Arg || len(*rewriteRefsArg) > 0 || *recompressArg != "") {
+		fmt.Printf("--copy-referrers needs the image to keep its digest, so it can not be combined with --force-schema1, --rewrite-refs or --recompress")
+		exitCode = exitUsage
 		return
 	}
+	if (len(*rewriteRefsArg) > 0 || *recompressArg != "") && (*allPlatformsArg || *destArgs.Digest != "") {
+		fmt.Printf("--rewrite-refs and --recompress change the digest of the image, so they can not be combined with --all-platforms or a destination digest")
+		exitCode = exitUsage
+		return
+	}
+
+	for _, patterns := range [][]string{*allowMediaTypeArg, *denyMediaTypeArg} {
+		err = validateMediaTypePatterns(patterns)
+		if err != nil {
+			fmt.Print(err)
+			exitCode = exitUsage
+			return
+		}
+	}
+
+	var tags []string
+	if *tagsFromStdinArg {
+		tags, err = readTags(os.Stdin)
+		if err != nil {
+			fmt.Printf("Failed to read the list of tags from stdin. %v", err)
+			exitCode = exitUsage
+			return
+		}
+		if len(tags) == 0 {
+			fmt.Printf("No tags were given on stdin")
+			exitCode = exitUsage
+			return
+		}
+		if *srcArgs.Digest != "" || *destArgs.Digest != "" {
+			fmt.Printf("--tags-from-stdin can not be combined with a digest")
+			exitCode = exitUsage
+			return
+		}
+		// Only the first tag is needed to spot a source and destination that
+		// are the same, the tag is shared by both sides
+		*srcArgs.Tag = tags[0]
+		*destArgs.Tag = tags[0]
+	}
 
-	if *destArgs.Repository == "" {
-		fmt.Printf("A destination repository name is required either with --dest-repo or --repo")
-		exitCode = -1
+	if isSameImage(srcArgs, destArgs) && !*forceArg {
+		fmt.Printf("The source and the destination both refer to %s. Use --force to copy anyway", srcArgs.ImageName())
+		exitCode = exitUsage
 		return
 	}
 
+	if !isDirTransport(*destArgs.RegistryURL) && !isOCILayoutTransport(*destArgs.RegistryURL) {
+		err = validateRepositoryName(*destArgs.Repository)
+		if err == nil {
+			err = validateRepositoryDepth(*destArgs.RegistryURL, *destArgs.Repository)
+		}
+		if err != nil {
+			fmt.Print(err)
+			exitCode = exitUsage
+			return
+		}
+	}
+
+	var deadline context.Context
+	if *deadlineArg > 0 {
+		var cancel context.CancelFunc
+		deadline, cancel = context.WithTimeout(context.Background(), *deadlineArg)
+		defer cancel()
+		srcArgs.Deadline = deadline
+		destArgs.Deadline = deadline
+	}
+	tally := &copyTally{}
+
 	srcHub, err := connectToRegistry(srcArgs)
 	if err != nil {
 		fmt.Printf("Failed to establish a connection to the source registry. %v", err)
-		exitCode = -1
+		exitCode = exitCodeFor(err)
+		reportDeadline(deadline, *deadlineArg, tally, nil, &exitCode)
 		return
 	}
 
 	destHub, err := connectToRegistry(destArgs)
 	if err != nil {
 		fmt.Printf("Failed to establish a connection to the destination registry. %v", err)
-		exitCode = -1
-		return
-	}
-
-	manifest, err := srcHub.Manifest(*srcArgs.Repository, *srcArgs.Tag)
-	if err != nil {
-		fmt.Printf("Failed to fetch the manifest for %s/%s:%s. %v", srcHub.URL, *srcArgs.Repository, *srcArgs.Tag, err)
-		exitCode = -1
+		exitCode = exitCodeFor(err)
+		reportDeadline(deadline, *deadlineArg, tally, nil, &exitCode)
 		return
 	}
 
-	for _, layer := range manifest.FSLayers {
-		err := migrateLayer(srcHub, destHub, *srcArgs.Repository, *destArgs.Repository, layer)
+	if *checkDestinationArg && !*dryRunArg {
+		err = checkDestinationRepository(destHub, *destArgs.Repository)
 		if err != nil {
-			fmt.Printf("Failed to migrate image layer. %v", err)
-			exitCode = -1
+			fmt.Print(err)
+			srcDepth, destDepth := repositoryDepth(*srcArgs.Repository), repositoryDepth(*destArgs.Repository)
+			if exitCodeFor(err) == exitUsage && srcDepth != destDepth {
+				fmt.Printf("\nThe destination repository has %d path component(s) where the source has %d, the destination registry may not support that depth", destDepth, srcDepth)
+			}
+			exitCode = exitCodeFor(err)
 			return
 		}
 	}
 
-	destManifest := &schema1.SignedManifest{
-		Manifest: manifest.Manifest,
+	manifestRetries := 0
+	if *retryOnManifestUnknownArg {
+		manifestRetries = *manifestRetriesArg
 	}
 
-	destManifest.Manifest.Name = *destArgs.Repository
+	manifestRetry := retryPolicy{
+		Retries:  manifestRetries,
+		Delay:    *manifestRetryDelayArg,
+		MaxDelay: *retryMaxDelayArg,
+		Deadline: deadline,
+	}
 
-	err = destHub.PutManifest(*destArgs.Repository, *destArgs.Tag, destManifest)
-	if err != nil {
-		fmt.Printf("Failed to upload manifest to %s/%s:%s. %v", destHub.URL, *destArgs.Repository, *destArgs.Tag, err)
-		exitCode = -1
+	options := copyOptions{
+		VerifyExistingLayers:    *verifyExistingArg,
+		OverwriteExistingLayers: *overwriteExistingLayersArg,
+		CleanupOnFailure:        *cleanupOnFailureArg,
+		ManifestRetry:           manifestRetry,
+		LayerRetry: retryPolicy{
+			Retries:  *layerRetriesArg,
+			Delay:    *layerRetryDelayArg,
+			MaxDelay: *retryMaxDelayArg,
+			Deadline: deadline,
+		},
+		StreamLayers:           *streamLayersArg,
+		DownloadSegments:       *downloadSegmentsArg,
+		Artifact:               *artifactArg,
+		DryRun:                 *dryRunArg,
+		TempPrefix:             *tempPrefixArg,
+		MemoryThreshold:        int64(*memoryThresholdArg),
+		MountLayers:            *mountLayersArg,
+		AllPlatforms:           *allPlatformsArg,
+		RewriteRefs:            *rewriteRefsArg,
+		Since:                  since,
+		Recompress:             *recompressArg,
+		MediaTypes:             mediaTypePolicy{Allow: *allowMediaTypeArg, Deny: *denyMediaTypeArg},
+		ForceSchema1:           *forceSchema1Arg,
+		Strict:                 *strictArg,
+		CopyReferrers:          *copyReferrersArg,
+		MaxTempBytes:           int64(*maxTempBytesArg),
+		TempBudget:             newTempBudget(int64(*maxTempBytesArg)),
+		VerifyPull:             *verifyPullArg,
+		ContinueOnMissingLayer: *continueOnMissingLayerArg,
+		Tally:                  tally,
+	}
+
+	if *progressArg {
+		stopProgress := reportProgress(transferProgress)
+		defer stopProgress()
+	}
+
+	var progress *checkpoint
+	if *resumeArg != "" {
+		progress, err = loadCheckpoint(*resumeArg)
+		if err != nil {
+			fmt.Printf("Failed to read the checkpoint %s. %v", *resumeArg, err)
+			exitCode = exitUsage
+			return
+		}
+	}
+
+	if !*tagsFromStdinArg {
+		if *printResolvedArg {
+			fmt.Printf("Copying %s to %s\n", resolvedImageName(srcHub.URL, *srcArgs.Repository, srcArgs.Reference()), resolvedImageName(destHub.URL, *destArgs.Repository, destArgs.Reference()))
+		}
+		err = copyImageWithCheckpoint(progress, srcHub, destHub, *srcArgs.Repository, srcArgs.Reference(), *destArgs.Repository, destArgs.Reference(), options)
+		if err != nil {
+			fmt.Print(err)
+			exitCode = exitCodeFor(err)
+			reportDeadline(deadline, *deadlineArg, tally, nil, &exitCode)
+			return
+		}
+		tags = []string{*destArgs.Tag}
+	} else {
+		failedTags := []string{}
+		unattempted := []string{}
+		for i, tag := range tags {
+			if deadlinePassed(deadline) {
+				unattempted = tags[i:]
+				failedTags = append(failedTags, unattempted...)
+				break
+			}
+			if *printResolvedArg {
+				fmt.Printf("Copying %s to %s\n", resolvedImageName(srcHub.URL, *srcArgs.Repository, tag), resolvedImageName(destHub.URL, *destArgs.Repository, tag))
+			} else {
+				fmt.Printf("Copying tag %s\n", tag)
+			}
+			err = copyImageWithCheckpoint(progress, srcHub, destHub, *srcArgs.Repository, tag, *destArgs.Repository, tag, options)
+			if err != nil {
+				fmt.Printf("Failed to copy tag %s. %v\n", tag, err)
+				failedTags = append(failedTags, tag)
+				// Report the first failure, later ones are often caused by it
+				if exitCode == 0 {
+					exitCode = exitCodeFor(err)
+				}
+			} else {
+				fmt.Printf("Copied tag %s\n", tag)
+			}
+		}
+
+		fmt.Printf("\nCopied %d of %d tag(s)\n", len(tags)-len(failedTags), len(tags))
+		if len(failedTags) > 0 {
+			fmt.Printf("Failed tags: %s", strings.Join(failedTags, ", "))
+			reportDeadline(deadline, *deadlineArg, tally, unattempted, &exitCode)
+			return
+		}
 	}
 
+	// Pruning only follows a complete copy, and never touches the tags it
+	// just copied
+	if *keepLastArg > 0 {
+		err = pruneTags(destHub, *destArgs.Repository, *keepLastArg, tags, *dryRunArg)
+		if err != nil {
+			fmt.Print(err)
+			exitCode = exitCodeFor(err)
+		}
+	}
 }
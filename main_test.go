@@ -0,0 +1,226 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestManifestWaitsForRewrittenConfig(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	image := src.addTestImage(t, "app", "1.0", map[string]string{"base": "old.example.com/base"}, []string{"a", "b"}, nil)
+	layers := map[string]bool{}
+	for _, layer := range image.Layers {
+		layers[digest.FromBytes(layer).String()] = true
+	}
+
+	var lock sync.Mutex
+	events := []string{}
+	record := func(event string) {
+		lock.Lock()
+		events = append(events, event)
+		lock.Unlock()
+	}
+	dest.Handler = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method == "PUT" && strings.Contains(req.URL.Path, "/manifests/") {
+			record("manifest")
+		}
+		if req.Method != "PUT" || !strings.Contains(req.URL.Path, "/blobs/uploads/") || layers[req.URL.Query().Get("digest")] {
+			return false
+		}
+		// Only the rewritten config is not a layer of the source, it is
+		// stalled to give an early manifest put the chance to happen
+		time.Sleep(200 * time.Millisecond)
+		path := strings.TrimPrefix(req.URL.Path, "/v2/")
+		i := strings.Index(path, "/blobs/uploads/")
+		dest.serveUpload(w, req, path[:i], path[i+len("/blobs/uploads/"):])
+		record("config")
+		return true
+	}
+
+	options := testCopyOptions()
+	options.RewriteRefs = map[string]string{"old.example.com": "new.example.com"}
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(events, ",") != "config,manifest" {
+		t.Errorf("Expected the config upload to finish before the manifest put, got %v", events)
+	}
+	manifest, ok := dest.Manifest("app", "1.0")
+	if !ok {
+		t.Fatal("Expected the manifest to be pushed")
+	}
+	parsed, err := parseRawManifest(manifest.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range parsed.BlobDescriptors() {
+		if _, ok := dest.Blob("app", blob.Digest); !ok {
+			t.Errorf("Expected blob %s to be in the destination", blob.Digest)
+		}
+	}
+}
+
+func TestResolveCopyArguments(t *testing.T) {
+	const pinned = "sha256:4c5156ba930a93cf9fb64c04903fe094c0fdc373a834691ac143953cd0686b72"
+	type image struct{ Repository, Tag, Digest string }
+	tests := []struct {
+		name          string
+		srcRef        string
+		destRef       string
+		src           image
+		dest          image
+		sharedRepo    string
+		sharedTag     string
+		destNamespace string
+		expectedSrc   image
+		expectedDest  image
+	}{
+		{
+			name:         "references alone",
+			srcRef:       "registry.example.com/team/app:1.0",
+			destRef:      "mirror.example.com/app:2.0",
+			expectedSrc:  image{"team/app", "1.0", ""},
+			expectedDest: image{"app", "2.0", ""},
+		},
+		{
+			name:         "flags override the references",
+			srcRef:       "registry.example.com/team/app:1.0",
+			destRef:      "mirror.example.com/app:2.0",
+			src:          image{Repository: "team/other"},
+			dest:         image{Tag: "3.0"},
+			expectedSrc:  image{"team/other", "1.0", ""},
+			expectedDest: image{"app", "3.0", ""},
+		},
+		{
+			name:         "a destination digest replaces the tag of the reference",
+			srcRef:       "registry.example.com/team/app:1.0",
+			destRef:      "mirror.example.com/app:2.0",
+			dest:         image{Digest: pinned},
+			expectedSrc:  image{"team/app", "1.0", ""},
+			expectedDest: image{"app", "", pinned},
+		},
+		{
+			name:         "shared flags fill in what the references lack",
+			srcRef:       "registry.example.com/team/app",
+			destRef:      "mirror.example.com/app",
+			sharedTag:    "1.0",
+			expectedSrc:  image{"team/app", "1.0", ""},
+			expectedDest: image{"app", "1.0", ""},
+		},
+		{
+			name:         "shared flags without references",
+			sharedRepo:   "team/app",
+			sharedTag:    "1.0",
+			expectedSrc:  image{"team/app", "1.0", ""},
+			expectedDest: image{"team/app", "1.0", ""},
+		},
+		{
+			name:         "a source digest without a destination tag is kept",
+			srcRef:       "registry.example.com/team/app@" + pinned,
+			destRef:      "mirror.example.com/app",
+			expectedSrc:  image{"team/app", "", pinned},
+			expectedDest: image{"app", "", pinned},
+		},
+		{
+			name:         "a source digest with a destination tag",
+			srcRef:       "registry.example.com/team/app@" + pinned,
+			destRef:      "mirror.example.com/app:stable",
+			expectedSrc:  image{"team/app", "", pinned},
+			expectedDest: image{"app", "stable", ""},
+		},
+		{
+			name:          "the namespace takes the name of the source",
+			srcRef:        "registry.example.com/library/nginx",
+			destNamespace: "/mirror/",
+			sharedRepo:    "team/app",
+			sharedTag:     "1.25",
+			expectedSrc:   image{"library/nginx", "1.25", ""},
+			expectedDest:  image{"mirror/nginx", "1.25", ""},
+		},
+		{
+			name:          "the destination repository wins over the namespace",
+			srcRef:        "registry.example.com/library/nginx",
+			dest:          image{Repository: "team/nginx"},
+			sharedTag:     "1.25",
+			destNamespace: "mirror",
+			expectedSrc:   image{"library/nginx", "1.25", ""},
+			expectedDest:  image{"team/nginx", "1.25", ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srcArgs := testArguments("src", "", test.src.Repository, test.src.Tag)
+			*srcArgs.Digest = test.src.Digest
+			destArgs := testArguments("dest", "", test.dest.Repository, test.dest.Tag)
+			*destArgs.Digest = test.dest.Digest
+
+			err := resolveCopyArguments(srcArgs, destArgs, test.srcRef, test.destRef, test.sharedRepo, test.sharedTag, test.destNamespace, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := image{*srcArgs.Repository, *srcArgs.Tag, *srcArgs.Digest}
+			if src != test.expectedSrc {
+				t.Errorf("Expected the source %+v, got %+v", test.expectedSrc, src)
+			}
+			dest := image{*destArgs.Repository, *destArgs.Tag, *destArgs.Digest}
+			if dest != test.expectedDest {
+				t.Errorf("Expected the destination %+v, got %+v", test.expectedDest, dest)
+			}
+		})
+	}
+}
+
+func TestInvalidDestNamespace(t *testing.T) {
+	for _, namespace := range []string{"/", "Mirror", "mirror//team", "mirror/-team"} {
+		srcArgs := testArguments("src", "", "", "")
+		destArgs := testArguments("dest", "", "", "")
+		err := resolveCopyArguments(srcArgs, destArgs, "registry.example.com/library/nginx:1.25", "", "", "", namespace, false)
+		if err == nil {
+			t.Errorf("Expected --dest-namespace %s to be refused, got %s", namespace, *destArgs.Repository)
+		}
+	}
+}
+
+func TestCopyTally(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	image := src.addTestImage(t, "app", "1.0", nil, []string{"a", "b"}, nil)
+
+	options := testCopyOptions()
+	options.Tally = &copyTally{}
+	for _, tag := range []string{"1.0", "1.1"} {
+		_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", tag, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	size := len(image.Config) + len(image.Layers[0]) + len(image.Layers[1])
+	expected := fmt.Sprintf("3 blob(s) were copied (%s) and 3 were already in the destination", formatBytes(int64(size)))
+	if options.Tally.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, options.Tally.String())
+	}
+}
@@ -0,0 +1,332 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+const (
+	ociManifestMediaType         = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType            = "application/vnd.oci.image.index.v1+json"
+	ociArtifactManifestMediaType = "application/vnd.oci.artifact.manifest.v1+json"
+)
+
+// imageManifestMediaTypes are the image manifests that can be copied, in
+// order of preference.
+var imageManifestMediaTypes = []string{
+	schema2.MediaTypeManifest,
+	ociManifestMediaType,
+	schema1.MediaTypeSignedManifest,
+	schema1.MediaTypeManifest,
+}
+
+// artifactManifestMediaTypes are the manifests that only reference blobs,
+// whatever those blobs hold.
+var artifactManifestMediaTypes = []string{
+	ociManifestMediaType,
+	ociArtifactManifestMediaType,
+	schema2.MediaTypeManifest,
+}
+
+// schema1ManifestMediaTypes are the manifests accepted when schema1 is
+// forced. Registries that store a newer manifest convert it on the fly.
+var schema1ManifestMediaTypes = []string{
+	schema1.MediaTypeSignedManifest,
+	schema1.MediaTypeManifest,
+}
+
+// indexMediaTypes are the manifests that list an image per platform.
+var indexMediaTypes = []string{
+	manifestlist.MediaTypeManifestList,
+	ociIndexMediaType,
+}
+
+// descriptor is the part of an OCI or schema2 content descriptor needed to
+// copy the content it points at.
+type descriptor struct {
+	MediaType    string        `json:"mediaType"`
+	ArtifactType string        `json:"artifactType,omitempty"`
+	Digest       digest.Digest `json:"digest"`
+	Size         int64         `json:"size"`
+	Platform     *platform     `json:"platform,omitempty"`
+}
+
+// platform is the platform of an image in a manifest list or OCI index.
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p *platform) String() string {
+	if p == nil {
+		return "unknown"
+	}
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// rawManifest is a loose view of any manifest or index. It is only used to
+// find the content a manifest references, schema2 and OCI manifests are
+// always copied as the original bytes.
+type rawManifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Blobs     []descriptor `json:"blobs"`
+	Manifests []descriptor `json:"manifests"`
+	FSLayers  []struct {
+		BlobSum digest.Digest `json:"blobSum"`
+	} `json:"fsLayers"`
+}
+
+func parseRawManifest(content []byte) (rawManifest, error) {
+	var manifest rawManifest
+	err := json.Unmarshal(content, &manifest)
+	return manifest, err
+}
+
+// BlobDescriptors lists the config and every layer or blob of a manifest.
+func (m rawManifest) BlobDescriptors() []descriptor {
+	descriptors := []descriptor{}
+	if m.Config != nil {
+		descriptors = append(descriptors, *m.Config)
+	}
+	descriptors = append(descriptors, m.Layers...)
+	descriptors = append(descriptors, m.Blobs...)
+	for _, layer := range m.FSLayers {
+		descriptors = append(descriptors, descriptor{Digest: layer.BlobSum})
+	}
+	return descriptors
+}
+
+func isSchema1MediaType(mediaType string) bool {
+	return mediaType == schema1.MediaTypeSignedManifest || mediaType == schema1.MediaTypeManifest
+}
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == ociIndexMediaType || mediaType == manifestlist.MediaTypeManifestList
+}
+
+// manifestMediaType reads the media type a manifest declares about itself,
+// schema1 manifests don't declare one and are always signed.
+func manifestMediaType(content []byte) string {
+	var versioned struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(content, &versioned) == nil && versioned.MediaType != "" {
+		return versioned.MediaType
+	}
+	return schema1.MediaTypeSignedManifest
+}
+
+// manifestDigest is the digest a registry identifies a manifest by. That is
+// the digest of its bytes, except for a signed schema1 manifest, which is
+// identified by its payload without the signatures.
+func manifestDigest(content []byte, mediaType string) digest.Digest {
+	if isSchema1MediaType(mediaType) {
+		var signed schema1.SignedManifest
+		if signed.UnmarshalJSON(content) == nil {
+			return digest.FromBytes(signed.Canonical)
+		}
+	}
+	return digest.FromBytes(content)
+}
+
+// getManifest fetches the original bytes of a manifest together with its
+// media type, accepting any of the given media types.
+func getManifest(hub *registry.Registry, repository string, reference string, mediaTypes []string) ([]byte, string, error) {
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", hub.URL, repository, reference)
+	hub.Logf("registry.manifest.get url=%s repository=%s reference=%s", url, repository, reference)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join(mediaTypes, ", "))
+
+	resp, err := hub.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Some registries answer with a generic JSON content type, so trust the
+	// manifest over the header in that case
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "" || mediaType == "application/json" || mediaType == "text/plain" {
+		mediaType = manifestMediaType(content)
+	}
+
+	return content, mediaType, nil
+}
+
+// putManifest uploads the bytes of a manifest unchanged, which keeps its
+// digest intact.
+func putManifest(hub *registry.Registry, repository string, reference string, mediaType string, content []byte) error {
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", hub.URL, repository, reference)
+	hub.Logf("registry.manifest.put url=%s repository=%s reference=%s", url, repository, reference)
+
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	resp, err := hub.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
+
+// knownManifestFields are the fields of the manifests, indexes and
+// descriptors this tool knows the meaning of.
+var knownManifestFields = map[string]bool{
+	"schemaVersion": true, "mediaType": true, "artifactType": true, "config": true,
+	"layers": true, "blobs": true, "manifests": true, "subject": true, "annotations": true,
+	"name": true, "tag": true, "architecture": true, "fsLayers": true, "history": true, "signatures": true,
+}
+
+var knownDescriptorFields = map[string]bool{
+	"mediaType": true, "artifactType": true, "digest": true, "size": true,
+	"urls": true, "annotations": true, "platform": true, "data": true,
+}
+
+// unknownManifestFields lists the fields of a manifest this tool doesn't
+// know, like layers[0].compression. Such fields are kept when a manifest is
+// rewritten, but they may refer to something the rewrite changed.
+func unknownManifestFields(content []byte) ([]string, error) {
+	var manifest map[string]interface{}
+	err := json.Unmarshal(content, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	unknown := []string{}
+	for key, value := range manifest {
+		if !knownManifestFields[key] {
+			unknown = append(unknown, key)
+			continue
+		}
+
+		entries, _ := value.([]interface{})
+		switch key {
+		case "config", "subject":
+			entries = []interface{}{value}
+		case "fsLayers":
+			unknown = append(unknown, unknownEntryFields(key, entries, map[string]bool{"blobSum": true})...)
+			continue
+		case "history":
+			unknown = append(unknown, unknownEntryFields(key, entries, map[string]bool{"v1Compatibility": true})...)
+			continue
+		case "layers", "blobs", "manifests":
+		default:
+			continue
+		}
+		unknown = append(unknown, unknownEntryFields(key, entries, knownDescriptorFields)...)
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+func unknownEntryFields(key string, entries []interface{}, known map[string]bool) []string {
+	unknown := []string{}
+	for i, entry := range entries {
+		fields, _ := entry.(map[string]interface{})
+		for field := range fields {
+			if known[field] {
+				continue
+			}
+			if key == "config" || key == "subject" {
+				unknown = append(unknown, fmt.Sprintf("%s.%s", key, field))
+			} else {
+				unknown = append(unknown, fmt.Sprintf("%s[%d].%s", key, i, field))
+			}
+		}
+	}
+	return unknown
+}
+
+// renameSchema1Manifest sets the repository name a schema1 manifest embeds.
+// The manifest is edited as plain JSON rather than through the schema1
+// types, so fields those don't know survive. The result is unsigned, the
+// signatures are only valid for the original name.
+func renameSchema1Manifest(manifest *schema1.SignedManifest, repository string) ([]byte, error) {
+	var parsed map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(manifest.Canonical))
+	decoder.UseNumber()
+	err := decoder.Decode(&parsed)
+	if err != nil {
+		return nil, err
+	}
+	delete(parsed, "signatures")
+	parsed["name"] = repository
+	return marshalJSON(parsed)
+}
+
+// imageCreated reads when an image was built from the created field of its
+// config blob.
+func imageCreated(hub *registry.Registry, repository string, config descriptor) (time.Time, error) {
+	reader, err := hub.DownloadLayer(repository, config.Digest)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer reader.Close()
+
+	var parsed struct {
+		Created time.Time `json:"created"`
+	}
+	err = json.NewDecoder(reader).Decode(&parsed)
+	return parsed.Created, err
+}
+
+// schema1Created reads when a schema1 image was built. The config of its top
+// layer, the first history entry, is the config of the image.
+func schema1Created(manifest *schema1.SignedManifest) (time.Time, error) {
+	if len(manifest.History) == 0 {
+		return time.Time{}, fmt.Errorf("The manifest has no history")
+	}
+
+	var parsed struct {
+		Created time.Time `json:"created"`
+	}
+	err := json.Unmarshal([]byte(manifest.History[0].V1Compatibility), &parsed)
+	return parsed.Created, err
+}
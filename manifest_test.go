@@ -0,0 +1,166 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+)
+
+func TestManifestDigest(t *testing.T) {
+	fake := newFakeRegistry(t)
+	image := fake.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+	if manifestDigest(image.Manifest, "application/vnd.docker.distribution.manifest.v2+json") != digest.FromBytes(image.Manifest) {
+		t.Error("Expected a schema2 manifest to be identified by its bytes")
+	}
+
+	content := fake.addSchema1Image(t, "app", "old", []string{"a"})
+	var signed schema1.SignedManifest
+	if err := signed.UnmarshalJSON(content); err != nil {
+		t.Fatal(err)
+	}
+	got := manifestDigest(content, schema1.MediaTypeSignedManifest)
+	if got != digest.FromBytes(signed.Canonical) || got == digest.FromBytes(content) {
+		t.Errorf("Expected a signed schema1 manifest to be identified by its payload, got %s", got)
+	}
+	if manifestDigest(signed.Canonical, schema1.MediaTypeManifest) != digest.FromBytes(signed.Canonical) {
+		t.Error("Expected an unsigned schema1 manifest to be identified by its bytes")
+	}
+}
+
+func TestAnnotationsAreCopiedVerbatim(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	image := src.addOCIImage(t, "app", "1.0", nil, []string{"a", "b"})
+
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", testCopyOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, ok := dest.Manifest("app", "1.0")
+	if !ok {
+		t.Fatal("Expected the manifest to be pushed")
+	}
+	if string(copied.Content) != string(image.Manifest) || digest.FromBytes(copied.Content) != image.Digest {
+		t.Errorf("Expected the manifest to be copied byte for byte with the digest %s, got %s", image.Digest, digest.FromBytes(copied.Content))
+	}
+}
+
+func TestIndexAnnotationsAreCopiedVerbatim(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	amd64 := src.addOCIImage(t, "app", "amd64", nil, []string{"a"})
+	arm64 := src.addOCIImage(t, "app", "arm64", nil, []string{"b"})
+	index := jsonBytes(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociIndexMediaType,
+		"manifests": []interface{}{
+			map[string]interface{}{
+				"mediaType":   ociManifestMediaType,
+				"size":        len(amd64.Manifest),
+				"digest":      amd64.Digest,
+				"platform":    map[string]string{"architecture": "amd64", "os": "linux"},
+				"annotations": map[string]string{"com.example.variant": "default"},
+			},
+			map[string]interface{}{
+				"mediaType":   ociManifestMediaType,
+				"size":        len(arm64.Manifest),
+				"digest":      arm64.Digest,
+				"platform":    map[string]string{"architecture": "arm64", "os": "linux"},
+				"annotations": map[string]string{"com.example.variant": "<arm & friends>"},
+			},
+		},
+		"annotations": map[string]string{"org.opencontainers.image.revision": "0123abc"},
+	})
+	indexDigest := src.AddManifest("app", "1.0", ociIndexMediaType, index)
+
+	options := testCopyOptions()
+	options.AllPlatforms = true
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied, ok := dest.Manifest("app", "1.0")
+	if !ok || string(copied.Content) != string(index) || digest.FromBytes(copied.Content) != indexDigest {
+		t.Error("Expected the index to be copied byte for byte")
+	}
+	for _, platformImage := range []testImage{amd64, arm64} {
+		copied, ok := dest.Manifest("app", platformImage.Digest.String())
+		if !ok || string(copied.Content) != string(platformImage.Manifest) {
+			t.Errorf("Expected the image %s to be copied byte for byte", platformImage.Digest)
+		}
+	}
+}
+
+// annotations collects the annotations of a manifest and of its config and
+// layer descriptors.
+func annotations(t *testing.T, content []byte) []interface{} {
+	var manifest struct {
+		Annotations interface{}
+		Config      struct{ Annotations interface{} }
+		Layers      []struct{ Annotations interface{} }
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	collected := []interface{}{manifest.Annotations, manifest.Config.Annotations}
+	for _, layer := range manifest.Layers {
+		collected = append(collected, layer.Annotations)
+	}
+	return collected
+}
+
+func TestAnnotationsSurviveRewrites(t *testing.T) {
+	tests := []struct {
+		name    string
+		options func(options *copyOptions)
+	}{
+		{"--rewrite-refs", func(options *copyOptions) {
+			options.RewriteRefs = map[string]string{"old.example.com": "new.example.com"}
+		}},
+		{"--recompress zstd", func(options *copyOptions) { options.Recompress = recompressionZstd }},
+		{"--recompress uncompressed", func(options *copyOptions) { options.Recompress = recompressionUncompressed }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := newFakeRegistry(t)
+			dest := newFakeRegistry(t)
+			image := src.addOCIImage(t, "app", "1.0", map[string]string{"base": "old.example.com/base"}, []string{"a", "b"})
+
+			options := testCopyOptions()
+			test.options(&options)
+			_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			copied, ok := dest.Manifest("app", "1.0")
+			if !ok {
+				t.Fatal("Expected the manifest to be pushed")
+			}
+			if string(copied.Content) == string(image.Manifest) {
+				t.Fatal("Expected the manifest to be rewritten")
+			}
+			if expected, got := annotations(t, image.Manifest), annotations(t, copied.Content); !reflect.DeepEqual(expected, got) {
+				t.Errorf("Expected the annotations %v, got %v", expected, got)
+			}
+		})
+	}
+}
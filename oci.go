@@ -0,0 +1,393 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+const (
+	ociTransportPrefix = "oci://"
+
+	ociLayoutFile    = "oci-layout"
+	ociLayoutVersion = `{"imageLayoutVersion":"1.0.0"}`
+	ociIndexFile     = "index.json"
+	ociBlobsDir      = "blobs"
+	ociRefNameKey    = "org.opencontainers.image.ref.name"
+)
+
+// An oci:// image is a directory in the OCI image layout, as written by
+// buildah, ko and other build tools: every manifest and blob is a file under
+// blobs/<algorithm>/<hex> and index.json names the images by their tag.
+// Like dirTransport, ociLayoutTransport answers the registry API requests of
+// the registry client from that directory.
+type ociLayoutTransport struct {
+	URL  string
+	Path string
+	// indexLock serializes the updates of index.json
+	indexLock sync.Mutex
+}
+
+// ociIndex is index.json. Its entries are kept loose, so fields this tool
+// doesn't know are written back unchanged.
+type ociIndex struct {
+	SchemaVersion int                      `json:"schemaVersion"`
+	MediaType     string                   `json:"mediaType,omitempty"`
+	Manifests     []map[string]interface{} `json:"manifests"`
+	Annotations   map[string]interface{}   `json:"annotations,omitempty"`
+}
+
+func isOCILayoutTransport(registryURL string) bool {
+	return strings.HasPrefix(registryURL, ociTransportPrefix)
+}
+
+func openOCILayout(registryURL string) (*registry.Registry, error) {
+	path, err := filepath.Abs(strings.TrimPrefix(registryURL, ociTransportPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve the OCI layout directory %s. %v", registryURL, err)
+	}
+
+	url := ociTransportPrefix + path
+	return &registry.Registry{
+		URL: url,
+		Client: &http.Client{
+			Transport: &registry.ErrorTransport{
+				Transport: &ociLayoutTransport{URL: url, Path: path},
+			},
+		},
+		Logf: registry.Log,
+	}, nil
+}
+
+func (t *ociLayoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := strings.TrimPrefix(req.URL.Path, strings.TrimPrefix(t.URL, ociTransportPrefix))
+
+	if path == "/v2/" || path == "/v2" {
+		return dirResponse(req, http.StatusOK, nil), nil
+	}
+	if strings.HasSuffix(path, "/tags/list") {
+		return t.tags(req, strings.TrimSuffix(strings.TrimPrefix(path, "/v2/"), "/tags/list"))
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		return t.manifest(req, path[i+len("/manifests/"):])
+	}
+	if i := strings.LastIndex(path, "/blobs/uploads/"); i >= 0 {
+		return t.upload(req, path[:i], path[i+len("/blobs/uploads/"):])
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		return t.blob(req, path[i+len("/blobs/"):])
+	}
+
+	return dirResponse(req, http.StatusNotFound, nil), nil
+}
+
+func (t *ociLayoutTransport) blobPath(blobDigest digest.Digest) string {
+	return filepath.Join(t.Path, ociBlobsDir, string(blobDigest.Algorithm()), blobDigest.Hex())
+}
+
+func (t *ociLayoutTransport) readIndex() (ociIndex, error) {
+	index := ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType}
+	content, err := ioutil.ReadFile(filepath.Join(t.Path, ociIndexFile))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(content, &index)
+	return index, err
+}
+
+// resolve finds the descriptor of a tag in index.json. A layout holding a
+// single untagged image serves it as latest, the tag used when none is given.
+func (t *ociLayoutTransport) resolve(tag string) (map[string]interface{}, error) {
+	index, err := t.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range index.Manifests {
+		annotations, _ := entry["annotations"].(map[string]interface{})
+		if annotations[ociRefNameKey] == tag {
+			return entry, nil
+		}
+	}
+	if tag == "latest" && len(index.Manifests) == 1 {
+		annotations, _ := index.Manifests[0]["annotations"].(map[string]interface{})
+		if _, ok := annotations[ociRefNameKey]; !ok {
+			return index.Manifests[0], nil
+		}
+	}
+	return nil, nil
+}
+
+func (t *ociLayoutTransport) manifest(req *http.Request, reference string) (*http.Response, error) {
+	switch req.Method {
+	case "GET", "HEAD":
+		mediaType := ""
+		manifestDigest, err := digest.ParseDigest(reference)
+		if err != nil {
+			entry, err := t.resolve(reference)
+			if err != nil {
+				return nil, err
+			}
+			if entry == nil {
+				return dirResponse(req, http.StatusNotFound, []byte(`{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`)), nil
+			}
+			manifestDigest, err = digest.ParseDigest(fmt.Sprint(entry["digest"]))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid digest in %s. %v", ociIndexFile, err)
+			}
+			mediaType, _ = entry["mediaType"].(string)
+		}
+
+		content, err := ioutil.ReadFile(t.blobPath(manifestDigest))
+		if os.IsNotExist(err) {
+			return dirResponse(req, http.StatusNotFound, []byte(`{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`)), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if mediaType == "" {
+			mediaType = ociContentMediaType(content)
+		}
+
+		resp := dirResponse(req, http.StatusOK, content)
+		resp.Header.Set("Content-Type", mediaType)
+		resp.Header.Set("Docker-Content-Digest", manifestDigest.String())
+		if req.Method == "HEAD" {
+			resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+		}
+		return resp, nil
+	case "PUT":
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		manifestDigest := digest.FromBytes(content)
+		err = t.writeFile(t.blobPath(manifestDigest), bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+
+		// Manifests pushed by digest, like the images of an index, are
+		// only kept as blobs. Tags are recorded in index.json.
+		if _, err := digest.ParseDigest(reference); err != nil {
+			err = t.tag(reference, map[string]interface{}{
+				"mediaType": req.Header.Get("Content-Type"),
+				"digest":    manifestDigest.String(),
+				"size":      len(content),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		resp := dirResponse(req, http.StatusCreated, nil)
+		resp.Header.Set("Docker-Content-Digest", manifestDigest.String())
+		return resp, nil
+	}
+
+	return dirResponse(req, http.StatusMethodNotAllowed, nil), nil
+}
+
+// tag points a tag at a manifest in index.json, replacing the image the tag
+// pointed at before.
+func (t *ociLayoutTransport) tag(tag string, entry map[string]interface{}) error {
+	t.indexLock.Lock()
+	defer t.indexLock.Unlock()
+
+	index, err := t.readIndex()
+	if err != nil {
+		return err
+	}
+
+	manifests := []map[string]interface{}{}
+	for _, existing := range index.Manifests {
+		annotations, _ := existing["annotations"].(map[string]interface{})
+		if annotations[ociRefNameKey] != tag {
+			manifests = append(manifests, existing)
+		}
+	}
+	entry["annotations"] = map[string]interface{}{ociRefNameKey: tag}
+	index.Manifests = append(manifests, entry)
+
+	content, err := marshalJSON(index)
+	if err != nil {
+		return err
+	}
+	return t.writeFile(filepath.Join(t.Path, ociIndexFile), bytes.NewReader(content))
+}
+
+func (t *ociLayoutTransport) tags(req *http.Request, repository string) (*http.Response, error) {
+	index, err := t.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, entry := range index.Manifests {
+		annotations, _ := entry["annotations"].(map[string]interface{})
+		if tag, ok := annotations[ociRefNameKey].(string); ok {
+			tags = append(tags, tag)
+		}
+	}
+
+	content, err := json.Marshal(map[string]interface{}{"name": repository, "tags": tags})
+	if err != nil {
+		return nil, err
+	}
+	resp := dirResponse(req, http.StatusOK, content)
+	resp.Header.Set("Content-Type", "application/json")
+	return resp, nil
+}
+
+func (t *ociLayoutTransport) blob(req *http.Request, reference string) (*http.Response, error) {
+	blobDigest, err := digest.ParseDigest(reference)
+	if err != nil {
+		return dirResponse(req, http.StatusBadRequest, nil), nil
+	}
+	blobPath := t.blobPath(blobDigest)
+
+	switch req.Method {
+	case "GET", "HEAD":
+		file, err := os.Open(blobPath)
+		if os.IsNotExist(err) {
+			return dirResponse(req, http.StatusNotFound, []byte(`{"errors":[{"code":"BLOB_UNKNOWN"}]}`)), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		resp := dirResponse(req, http.StatusOK, nil)
+		resp.ContentLength = info.Size()
+		resp.Header.Set("Docker-Content-Digest", blobDigest.String())
+		if req.Method == "GET" {
+			resp.Body = file
+		} else {
+			file.Close()
+		}
+		return resp, nil
+	case "DELETE":
+		err := os.Remove(blobPath)
+		if os.IsNotExist(err) {
+			return dirResponse(req, http.StatusNotFound, nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return dirResponse(req, http.StatusAccepted, nil), nil
+	}
+
+	return dirResponse(req, http.StatusMethodNotAllowed, nil), nil
+}
+
+// upload implements the monolithic upload the registry client does, like
+// dirTransport.upload.
+func (t *ociLayoutTransport) upload(req *http.Request, repositoryPath string, uploadID string) (*http.Response, error) {
+	switch {
+	case req.Method == "POST" && uploadID == "":
+		id := make([]byte, 16)
+		_, err := rand.Read(id)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := dirResponse(req, http.StatusAccepted, nil)
+		resp.Header.Set("Location", fmt.Sprintf("%s%s/blobs/uploads/%s", t.URL, repositoryPath, hex.EncodeToString(id)))
+		return resp, nil
+	case req.Method == "PUT" && uploadID != "":
+		blobDigest, err := digest.ParseDigest(req.URL.Query().Get("digest"))
+		if err != nil {
+			return dirResponse(req, http.StatusBadRequest, []byte(`{"errors":[{"code":"DIGEST_INVALID"}]}`)), nil
+		}
+
+		verifier, err := digest.NewDigestVerifier(blobDigest)
+		if err != nil {
+			return dirResponse(req, http.StatusBadRequest, []byte(`{"errors":[{"code":"DIGEST_INVALID"}]}`)), nil
+		}
+
+		err = t.writeFile(t.blobPath(blobDigest), &verifiedReader{Reader: req.Body, Verifier: verifier})
+		if err == errBlobDigestMismatch {
+			return dirResponse(req, http.StatusBadRequest, []byte(`{"errors":[{"code":"DIGEST_INVALID"}]}`)), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		resp := dirResponse(req, http.StatusCreated, nil)
+		resp.Header.Set("Docker-Content-Digest", blobDigest.String())
+		return resp, nil
+	}
+
+	return dirResponse(req, http.StatusMethodNotAllowed, nil), nil
+}
+
+// writeFile writes a file of the layout, creating the layout first.
+func (t *ociLayoutTransport) writeFile(path string, content io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	layoutPath := filepath.Join(t.Path, ociLayoutFile)
+	if _, err := os.Stat(layoutPath); os.IsNotExist(err) {
+		err = ioutil.WriteFile(layoutPath, []byte(ociLayoutVersion), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomically(path, content)
+}
+
+// ociContentMediaType tells the media type of a manifest that doesn't
+// declare one, which is optional for OCI manifests and indexes.
+func ociContentMediaType(content []byte) string {
+	var parsed struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+		Config    json.RawMessage `json:"config"`
+	}
+	if json.Unmarshal(content, &parsed) != nil {
+		return ociManifestMediaType
+	}
+	switch {
+	case parsed.MediaType != "":
+		return parsed.MediaType
+	case parsed.Manifests != nil:
+		return ociIndexMediaType
+	case parsed.Config != nil:
+		return ociManifestMediaType
+	}
+	return manifestMediaType(content)
+}
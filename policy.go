@@ -0,0 +1,74 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+// mediaTypePolicy decides which blob media types may be copied at all.
+// Patterns are matched with path.Match, so application/vnd.oci.image.layer.*
+// matches every OCI layer. Without allowed patterns anything not denied is
+// allowed.
+type mediaTypePolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+func validateMediaTypePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid media type pattern %s. %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Check refuses the copy when any of the blobs has a media type the policy
+// doesn't permit, before anything is transferred.
+func (p mediaTypePolicy) Check(blobs []descriptor) error {
+	if len(p.Allow) == 0 && len(p.Deny) == 0 {
+		return nil
+	}
+
+	for _, blob := range blobs {
+		// schema1 manifests don't record media types, their layers are
+		// always gzip compressed tarballs
+		mediaType := blob.MediaType
+		if mediaType == "" {
+			mediaType = schema2.MediaTypeLayer
+		}
+
+		if pattern, ok := matchMediaType(p.Deny, mediaType); ok {
+			return fmt.Errorf("Refusing to copy blob %s, its media type %s is denied by %s", blob.Digest, mediaType, pattern)
+		}
+		if _, ok := matchMediaType(p.Allow, mediaType); len(p.Allow) > 0 && !ok {
+			return fmt.Errorf("Refusing to copy blob %s, its media type %s is not allowed", blob.Digest, mediaType)
+		}
+	}
+	return nil
+}
+
+func matchMediaType(patterns []string, mediaType string) (string, bool) {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, mediaType); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
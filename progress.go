@@ -0,0 +1,282 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressTracker adds up the blob downloads of a copy. Downloads running at
+// the same time, like the segments of a layer, all feed the one tracker, so
+// progress is reported as a single line instead of one garbled line each.
+type progressTracker struct {
+	lock     sync.Mutex
+	inFlight int
+	done     int64
+	expected int64
+	// drawn is set while a progress line is shown in place on a terminal,
+	// which has to be cleared before any other output
+	drawn bool
+	// midLine is set while other output has not finished its line yet, the
+	// progress line is not drawn over it
+	midLine bool
+	// out is where the progress goes, the real stdout while the tracker
+	// captures the rest of the output
+	out io.Writer
+}
+
+// transferProgress tracks every download of the process. It is shared by the
+// transports of both registries, unlike a limitTransport, which only bounds
+// the connections to its own registry.
+var transferProgress = &progressTracker{}
+
+// Expect adds a layer that is about to be copied to the total.
+func (p *progressTracker) Expect(size int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if size > 0 {
+		p.expected += size
+	}
+}
+
+func (p *progressTracker) started() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.inFlight++
+}
+
+func (p *progressTracker) finished() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.inFlight--
+	if p.inFlight == 0 {
+		p.clear()
+	}
+}
+
+func (p *progressTracker) output() io.Writer {
+	if p.out == nil {
+		return os.Stdout
+	}
+	return p.out
+}
+
+// clear removes the progress line from the terminal, if it is shown.
+func (p *progressTracker) clear() {
+	if p.drawn {
+		fmt.Fprint(p.output(), "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// captureOutput sends everything else printed to stdout through the tracker
+// until the returned function is called, so the progress line is cleared
+// before any other line is printed instead of being garbled by it.
+func (p *progressTracker) captureOutput(out io.Writer) (func(), error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := os.Stdout
+	p.lock.Lock()
+	p.out = out
+	p.lock.Unlock()
+	os.Stdout = writer
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := reader.Read(buffer)
+			if n > 0 {
+				p.lock.Lock()
+				p.clear()
+				out.Write(buffer[:n])
+				p.midLine = buffer[n-1] != '\n'
+				p.lock.Unlock()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return func() {
+		os.Stdout = stdout
+		writer.Close()
+		<-done
+		reader.Close()
+		p.lock.Lock()
+		p.out = nil
+		p.midLine = false
+		p.lock.Unlock()
+	}, nil
+}
+
+func (p *progressTracker) add(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done += int64(n)
+}
+
+func (p *progressTracker) String() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.line()
+}
+
+func (p *progressTracker) line() string {
+	return fmt.Sprintf("%d download(s) in flight, %s of %s downloaded", p.inFlight, formatBytes(p.done), formatBytes(p.expected))
+}
+
+// print shows the progress while any download is in flight.
+func (p *progressTracker) print(terminal bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.inFlight == 0 || terminal && p.midLine {
+		return
+	}
+	if terminal {
+		fmt.Fprintf(p.output(), "\r%s\033[K", p.line())
+		p.drawn = true
+	} else {
+		fmt.Fprintln(p.output(), p.line())
+	}
+}
+
+// copyTally counts the blobs a run has taken care of, so that a copy cut
+// short by --deadline can tell how far it got. Every method does nothing on
+// a nil tally.
+type copyTally struct {
+	lock     sync.Mutex
+	uploaded int
+	present  int
+	bytes    int64
+}
+
+// Blob records a layer or config that is in the destination now, uploaded
+// by the copy or found there already.
+func (t *copyTally) Blob(uploaded bool, size int64) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !uploaded {
+		t.present++
+		return
+	}
+	t.uploaded++
+	if size > 0 {
+		t.bytes += size
+	}
+}
+
+func (t *copyTally) String() string {
+	if t == nil {
+		return "no blobs were copied"
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return fmt.Sprintf("%d blob(s) were copied (%s) and %d were already in the destination", t.uploaded, formatBytes(t.bytes), t.present)
+}
+
+// progressTransport counts the bytes of every blob downloaded from a
+// registry.
+type progressTransport struct {
+	Transport http.RoundTripper
+	Tracker   *progressTracker
+}
+
+func (t *progressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil || req.Method != "GET" || resp.StatusCode >= 300 || !strings.Contains(req.URL.Path, "/blobs/") {
+		return resp, err
+	}
+
+	t.Tracker.started()
+	resp.Body = &countingBody{ReadCloser: resp.Body, tracker: t.Tracker}
+	return resp, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	tracker *progressTracker
+	once    sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.tracker.add(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.tracker.finished)
+	return err
+}
+
+// reportProgress prints the progress of the downloads while any are in
+// flight until the returned function is called. On a terminal a single line
+// is updated in place, with the other output going through the tracker so
+// the line is cleared first, otherwise a line is logged every now and then.
+func reportProgress(tracker *progressTracker) func() {
+	interval := 10 * time.Second
+	terminal := isTerminal(os.Stdout)
+	restoreOutput := func() {}
+	if terminal {
+		interval = 500 * time.Millisecond
+		restore, err := tracker.captureOutput(os.Stdout)
+		if err == nil {
+			restoreOutput = restore
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				tracker.print(terminal)
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+		restoreOutput()
+	}
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestProgressLineIsClearedBeforeOtherOutput(t *testing.T) {
+	tracker := &progressTracker{}
+	var out bytes.Buffer
+	restore, err := tracker.captureOutput(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Expect(100)
+	tracker.started()
+	tracker.print(true)
+	fmt.Println("Recompressing layer sha256:abc as zstd")
+	restore()
+
+	expected := "\r" + tracker.String() + "\033[K\r\033[KRecompressing layer sha256:abc as zstd\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestRecompressedLayersAreExpected(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	image := src.addTestImage(t, "app", "1.0", nil, []string{"a", "b"}, nil)
+
+	expected := func() int64 {
+		transferProgress.lock.Lock()
+		defer transferProgress.lock.Unlock()
+		return transferProgress.expected
+	}
+	before := expected()
+	options := testCopyOptions()
+	options.Recompress = recompressionZstd
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The config is copied unchanged and expected as well
+	size := int64(len(image.Config) + len(image.Layers[0]) + len(image.Layers[1]))
+	if added := expected() - before; added != size {
+		t.Errorf("Expected the copy to add %d bytes to the total, it added %d", size, added)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// destinationTag is a tag considered for pruning, with what it points at.
+type destinationTag struct {
+	Name    string
+	Digest  digest.Digest
+	Created time.Time
+}
+
+// pruneTags deletes all but the newest keep tags of a repository. Tags are
+// ordered by semantic version when every tag is one, by the time the image
+// was created otherwise. Because the registry can only delete a manifest
+// with all of its tags, nothing is deleted that a kept tag still points at,
+// and neither are the protected tags or, when ordering by time, images that
+// don't record when they were created.
+func pruneTags(hub *registry.Registry, repository string, keep int, protected []string, dryRun bool) error {
+	names, err := hub.Tags(repository)
+	if err != nil {
+		return fmt.Errorf("Failed to list the tags of %s/%s. %v", hub.URL, repository, err)
+	}
+	if len(names) <= keep {
+		fmt.Printf("%s/%s has %d tag(s), nothing to prune\n", hub.URL, repository, len(names))
+		return nil
+	}
+
+	mediaTypes := append(append([]string{}, imageManifestMediaTypes...), indexMediaTypes...)
+	tags := []destinationTag{}
+	for _, name := range names {
+		content, mediaType, err := getManifest(hub, repository, name, mediaTypes)
+		if err != nil {
+			return fmt.Errorf("Failed to fetch the manifest for %s/%s:%s. %v", hub.URL, repository, name, err)
+		}
+		// Deleting goes by the digest the registry knows the manifest by
+		tag := destinationTag{Name: name, Digest: manifestDigest(content, mediaType)}
+		if !allSemanticVersions(names) {
+			tag.Created, err = manifestCreated(hub, repository, mediaType, content)
+			if err != nil {
+				return fmt.Errorf("Failed to read when %s/%s:%s was created. %v", hub.URL, repository, name, err)
+			}
+		}
+		tags = append(tags, tag)
+	}
+
+	if allSemanticVersions(names) {
+		sort.SliceStable(tags, func(i, j int) bool {
+			return compareSemanticVersions(tags[i].Name, tags[j].Name) > 0
+		})
+	} else {
+		sort.SliceStable(tags, func(i, j int) bool {
+			return tags[i].Created.After(tags[j].Created)
+		})
+	}
+
+	keptDigests := map[digest.Digest]bool{}
+	for i, tag := range tags {
+		if i < keep || containsString(protected, tag.Name) || tag.Created.IsZero() && !allSemanticVersions(names) {
+			keptDigests[tag.Digest] = true
+		}
+	}
+
+	deleted := 0
+	for _, tag := range tags {
+		if keptDigests[tag.Digest] {
+			continue
+		}
+		// Other tags of the same image go with the first one
+		keptDigests[tag.Digest] = true
+
+		if dryRun {
+			fmt.Printf("Dry run: would delete tag %s (%s)\n", tag.Name, tag.Digest)
+			continue
+		}
+
+		err = hub.DeleteManifest(repository, tag.Digest)
+		if err != nil {
+			return fmt.Errorf("Failed to delete tag %s of %s/%s. %v", tag.Name, hub.URL, repository, err)
+		}
+		fmt.Printf("Deleted tag %s (%s)\n", tag.Name, tag.Digest)
+		deleted++
+	}
+
+	if !dryRun {
+		fmt.Printf("Deleted %d image(s) from %s/%s\n", deleted, hub.URL, repository)
+	}
+	return nil
+}
+
+// manifestCreated reads when the image of a manifest was created. Manifest
+// lists don't record it and report the zero time.
+func manifestCreated(hub *registry.Registry, repository string, mediaType string, content []byte) (time.Time, error) {
+	if isIndexMediaType(mediaType) {
+		return time.Time{}, nil
+	}
+	if isSchema1MediaType(mediaType) {
+		manifest := &schema1.SignedManifest{}
+		err := manifest.UnmarshalJSON(content)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return schema1Created(manifest)
+	}
+
+	manifest, err := parseRawManifest(content)
+	if err != nil || manifest.Config == nil {
+		return time.Time{}, err
+	}
+	return imageCreated(hub, repository, *manifest.Config)
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+var semanticVersionPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+func allSemanticVersions(tags []string) bool {
+	for _, tag := range tags {
+		if !semanticVersionPattern.MatchString(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// compareSemanticVersions compares two versions by the rules of semver.org,
+// returning a negative number when a is older than b, zero when they are the
+// same version and a positive number when a is newer.
+func compareSemanticVersions(a string, b string) int {
+	partsA := semanticVersionPattern.FindStringSubmatch(a)
+	partsB := semanticVersionPattern.FindStringSubmatch(b)
+	for i := 1; i <= 3; i++ {
+		if c := compareNumbers(partsA[i], partsB[i]); c != 0 {
+			return c
+		}
+	}
+
+	// A pre-release is older than the release itself
+	preA, preB := partsA[4], partsB[4]
+	if preA == "" || preB == "" {
+		return len(preB) - len(preA)
+	}
+
+	fieldsA := strings.Split(preA, ".")
+	fieldsB := strings.Split(preB, ".")
+	for i := 0; i < len(fieldsA) && i < len(fieldsB); i++ {
+		_, errA := strconv.ParseUint(fieldsA[i], 10, 64)
+		_, errB := strconv.ParseUint(fieldsB[i], 10, 64)
+		var c int
+		switch {
+		case errA == nil && errB == nil:
+			c = compareNumbers(fieldsA[i], fieldsB[i])
+		case errA == nil:
+			// Numeric identifiers are older than alphanumeric ones
+			c = -1
+		case errB == nil:
+			c = 1
+		default:
+			c = strings.Compare(fieldsA[i], fieldsB[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return len(fieldsA) - len(fieldsB)
+}
+
+// compareNumbers compares two decimal numbers of any length.
+func compareNumbers(a string, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
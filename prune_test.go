@@ -0,0 +1,34 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestPruneSchema1Tags(t *testing.T) {
+	fake := newFakeRegistry(t)
+	for _, tag := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+		fake.addSchema1Image(t, "app", tag, []string{"a", tag})
+	}
+
+	err := pruneTags(fake.Hub(t), "app", 1, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tag, kept := range map[string]bool{"1.0.0": false, "1.1.0": false, "1.2.0": true} {
+		if _, ok := fake.Manifest("app", tag); ok != kept {
+			t.Errorf("Expected tag %s to be kept: %v, but it was: %v", tag, kept, ok)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/heroku/docker-registry-client/registry"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ociConfigMediaType           = "application/vnd.oci.image.config.v1+json"
+	ociGzipLayerMediaType        = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociZstdLayerMediaType        = "application/vnd.oci.image.layer.v1.tar+zstd"
+	ociTarLayerMediaType         = "application/vnd.oci.image.layer.v1.tar"
+	ociNondistributableMediaType = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+	dockerTarLayerMediaType      = "application/vnd.docker.image.rootfs.diff.tar"
+
+	recompressionZstd         = "zstd"
+	recompressionGzip         = "gzip"
+	recompressionUncompressed = "uncompressed"
+)
+
+// recompressedMediaTypes maps each --recompress choice to the layer media
+// types it converts and the media type of the converted layer.
+var recompressedMediaTypes = map[string]map[string]string{
+	recompressionZstd: {
+		schema2.MediaTypeLayer: ociZstdLayerMediaType,
+		ociGzipLayerMediaType:  ociZstdLayerMediaType,
+	},
+	recompressionGzip: {
+		dockerTarLayerMediaType: schema2.MediaTypeLayer,
+		ociTarLayerMediaType:    ociGzipLayerMediaType,
+	},
+	recompressionUncompressed: {
+		schema2.MediaTypeLayer: dockerTarLayerMediaType,
+		ociGzipLayerMediaType:  ociTarLayerMediaType,
+	},
+}
+
+// ociMediaTypes are the OCI equivalents of the schema2 media types, used when
+// a schema2 manifest has to become an OCI one because schema2 has no media
+// type for zstd layers.
+var ociMediaTypes = map[string]string{
+	schema2.MediaTypeManifest:     ociManifestMediaType,
+	schema2.MediaTypeConfig:       ociConfigMediaType,
+	schema2.MediaTypeLayer:        ociGzipLayerMediaType,
+	schema2.MediaTypeForeignLayer: ociNondistributableMediaType,
+	dockerTarLayerMediaType:       ociTarLayerMediaType,
+}
+
+// recompressLayers converts the layers of an image to the compression chosen
+// with --recompress and uploads them to the destination. The layers get new
+// digests, so the manifest is rewritten to reference them. For zstd it is
+// converted to an OCI manifest when it was a schema2 one. The config stays
+// the same, its diff_ids are the digests of the uncompressed layers, which
+// the conversion checks instead. It returns the new manifest with its media
+// type, the blobs that still have to be copied unchanged and the layers it
+// uploaded.
+func recompressLayers(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, content []byte, mediaType string, blobs []descriptor, diffIDs []digest.Digest, options copyOptions) ([]byte, string, []descriptor, []digest.Digest, error) {
+	uploaded := []digest.Digest{}
+
+	var manifest map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	err := decoder.Decode(&manifest)
+	if err != nil {
+		return content, mediaType, blobs, uploaded, err
+	}
+	layers, _ := manifest["layers"].([]interface{})
+	if len(diffIDs) != len(layers) {
+		diffIDs = nil
+	}
+
+	recompressed := map[digest.Digest]bool{}
+	for i, entry := range layers {
+		layer, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		layerMediaType, _ := layer["mediaType"].(string)
+		newMediaType, ok := recompressedMediaTypes[options.Recompress][layerMediaType]
+		if !ok {
+			if ociMediaType, ok := ociMediaTypes[layerMediaType]; ok && options.Recompress == recompressionZstd {
+				layer["mediaType"] = ociMediaType
+			}
+			continue
+		}
+
+		layerDigest, err := digest.ParseDigest(fmt.Sprint(layer["digest"]))
+		if err != nil {
+			return content, mediaType, blobs, uploaded, err
+		}
+		layerSize, _ := strconv.ParseInt(fmt.Sprint(layer["size"]), 10, 64)
+		fmt.Println("Recompressing layer", layerDigest, "as", options.Recompress)
+		transferProgress.Expect(layerSize)
+		newDigest, size, diffID, wasUploaded, err := recompressLayer(srcHub, destHub, srcRepo, destRepo, descriptor{Digest: layerDigest, Size: layerSize}, options)
+		if wasUploaded {
+			uploaded = append(uploaded, newDigest)
+		}
+		if err == nil && diffIDs != nil && diffID != diffIDs[i] {
+			err = fmt.Errorf("The uncompressed layer has the digest %s, but the image config expects %s", diffID, diffIDs[i])
+		}
+		if err != nil {
+			return content, mediaType, blobs, uploaded, fmt.Errorf("Failed to recompress layer %s. %v", layerDigest, err)
+		}
+
+		options.Tally.Blob(wasUploaded, size)
+		recompressed[layerDigest] = true
+		layer["mediaType"] = newMediaType
+		layer["digest"] = newDigest.String()
+		layer["size"] = size
+	}
+	if len(recompressed) == 0 {
+		return content, mediaType, blobs, uploaded, nil
+	}
+
+	if options.Recompress == recompressionZstd {
+		if config, ok := manifest["config"].(map[string]interface{}); ok {
+			if ociMediaType, ok := ociMediaTypes[fmt.Sprint(config["mediaType"])]; ok {
+				config["mediaType"] = ociMediaType
+			}
+		}
+		if ociMediaType, ok := ociMediaTypes[mediaType]; ok {
+			mediaType = ociMediaType
+			manifest["mediaType"] = ociMediaType
+		}
+	}
+
+	newContent, err := marshalJSON(manifest)
+	if err != nil {
+		return content, mediaType, blobs, uploaded, err
+	}
+
+	remaining := []descriptor{}
+	for _, blob := range blobs {
+		if !recompressed[blob.Digest] {
+			remaining = append(remaining, blob)
+		}
+	}
+	return newContent, mediaType, remaining, uploaded, nil
+}
+
+// imageDiffIDs reads the digests of the uncompressed layers of an image from
+// the rootfs of its config blob. Artifacts have no such config.
+func imageDiffIDs(hub *registry.Registry, repository string, config descriptor) ([]digest.Digest, error) {
+	if config.MediaType != schema2.MediaTypeConfig && config.MediaType != ociConfigMediaType {
+		return nil, nil
+	}
+
+	reader, err := hub.DownloadLayer(repository, config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var parsed struct {
+		RootFS struct {
+			DiffIDs []digest.Digest `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	err = json.NewDecoder(reader).Decode(&parsed)
+	return parsed.RootFS.DiffIDs, err
+}
+
+// recompressLayer downloads a layer, verifies it and uploads it with the
+// given compression unless the destination already has the result. It
+// returns the digest and size of the new layer, the digest of the
+// uncompressed layer and whether the new layer was uploaded. The layer is
+// verified while it is recompressed, so a retry of that stage starts over
+// with an empty temp file, while the upload is retried on its own.
+func recompressLayer(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, layer descriptor, options copyOptions) (digest.Digest, int64, digest.Digest, bool, error) {
+	layerDigest := layer.Digest
+	var newDigest, diffID digest.Digest
+	var size int64
+	uploaded := false
+
+	compression := options.Recompress
+	// The recompressed layer is about as large as the source one, when it
+	// grows, like when it is decompressed, it takes more of the budget
+	err := withTempFile(options.TempPrefix, options.TempBudget, layer.Size, func(file *os.File, reservation *tempReservation) error {
+		err := retryTransient("Recompressing layer "+layerDigest.String(), options.LayerRetry, func() error {
+			_, err := file.Seek(0, io.SeekStart)
+			if err == nil {
+				err = file.Truncate(0)
+			}
+			if err != nil {
+				return err
+			}
+
+			reader, err := srcHub.DownloadLayer(srcRepo, layerDigest)
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+
+			verifier, err := digest.NewDigestVerifier(layerDigest)
+			if err != nil {
+				return err
+			}
+			source := io.TeeReader(reader, verifier)
+			var uncompressed io.Reader = source
+			if compression != recompressionGzip {
+				uncompressed, err = gzip.NewReader(source)
+				if err != nil {
+					return err
+				}
+			}
+			diffIDDigester := digest.Canonical.New()
+			uncompressed = io.TeeReader(uncompressed, diffIDDigester.Hash())
+
+			digester := digest.Canonical.New()
+			encoder, err := compressingWriter(io.MultiWriter(reservation.Writer(file), digester.Hash()), compression)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(encoder, uncompressed)
+			if err == nil {
+				err = encoder.Close()
+			}
+			if err != nil {
+				return err
+			}
+
+			// Anything after the gzip stream still counts for the digest
+			_, err = io.Copy(ioutil.Discard, source)
+			if err != nil {
+				return err
+			}
+			if !verifier.Verified() {
+				return fmt.Errorf("The layer does not match its digest")
+			}
+
+			newDigest = digester.Digest()
+			diffID = diffIDDigester.Digest()
+			size, err = file.Seek(0, io.SeekCurrent)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		var exists bool
+		err = retryTransient("Checking layer "+newDigest.String(), options.LayerRetry, func() error {
+			var err error
+			exists, err = destHub.HasLayer(destRepo, newDigest)
+			return err
+		})
+		if err != nil || exists {
+			return err
+		}
+		err = uploadLayerFromFile(destHub, destRepo, newDigest, file, options.LayerRetry)
+		uploaded = err == nil
+		return err
+	})
+	return newDigest, size, diffID, uploaded, err
+}
+
+// compressingWriter compresses what is written to it with the given
+// compression before passing it on to the writer.
+func compressingWriter(writer io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case recompressionZstd:
+		return zstd.NewWriter(writer)
+	case recompressionGzip:
+		return gzip.NewWriter(writer), nil
+	}
+	return nopWriteCloser{writer}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// addImageWithLayers pushes a schema2 image with the given layers as they
+// are, each with its media type, and a config claiming the given diff_ids
+// for them.
+func (r *fakeRegistry) addImageWithLayers(t *testing.T, repository string, tag string, layerMediaTypes []string, layers [][]byte, diffIDs []digest.Digest) testImage {
+	image := testImage{Layers: layers, DiffIDs: diffIDs}
+	descriptors := []map[string]interface{}{}
+	for i, layer := range layers {
+		descriptors = append(descriptors, map[string]interface{}{
+			"mediaType": layerMediaTypes[i],
+			"size":      len(layer),
+			"digest":    r.AddBlob(repository, layer),
+		})
+	}
+
+	image.Config = jsonBytes(t, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	image.Manifest = jsonBytes(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     schema2.MediaTypeManifest,
+		"config": map[string]interface{}{
+			"mediaType": schema2.MediaTypeConfig,
+			"size":      len(image.Config),
+			"digest":    r.AddBlob(repository, image.Config),
+		},
+		"layers": descriptors,
+	})
+	image.Digest = r.AddManifest(repository, tag, schema2.MediaTypeManifest, image.Manifest)
+	return image
+}
+
+// decompress undoes the compression of a layer pushed by a recompression.
+func decompress(t *testing.T, layer []byte, compression string) []byte {
+	var reader io.Reader = bytes.NewReader(layer)
+	switch compression {
+	case recompressionGzip:
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = gzipReader
+	case recompressionZstd:
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+		reader = decoder
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestRecompressRoundTrip(t *testing.T) {
+	tests := []struct {
+		compression       string
+		uncompressed      bool
+		manifestMediaType string
+		layerMediaType    string
+	}{
+		{recompressionZstd, false, ociManifestMediaType, ociZstdLayerMediaType},
+		{recompressionUncompressed, false, schema2.MediaTypeManifest, dockerTarLayerMediaType},
+		{recompressionGzip, true, schema2.MediaTypeManifest, schema2.MediaTypeLayer},
+	}
+	for _, test := range tests {
+		t.Run(test.compression, func(t *testing.T) {
+			src := newFakeRegistry(t)
+			dest := newFakeRegistry(t)
+			var image testImage
+			if test.uncompressed {
+				layers := [][]byte{tarLayer(t, map[string]string{"a": "content of a"}), tarLayer(t, map[string]string{"b": "content of b"})}
+				image = src.addImageWithLayers(t, "app", "1.0", []string{dockerTarLayerMediaType, dockerTarLayerMediaType}, layers, []digest.Digest{digest.FromBytes(layers[0]), digest.FromBytes(layers[1])})
+			} else {
+				image = src.addTestImage(t, "app", "1.0", nil, []string{"a", "b"}, nil)
+			}
+
+			options := testCopyOptions()
+			options.Recompress = test.compression
+			_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			copied, ok := dest.Manifest("app", "1.0")
+			if !ok {
+				t.Fatal("Expected the manifest to be pushed")
+			}
+			var manifest struct {
+				MediaType string
+				Config    struct{ Digest digest.Digest }
+				Layers    []struct {
+					MediaType string
+					Size      int64
+					Digest    digest.Digest
+				}
+			}
+			if err := json.Unmarshal(copied.Content, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			if manifest.MediaType != test.manifestMediaType || copied.MediaType != test.manifestMediaType {
+				t.Errorf("Expected the manifest media type %s, got %s", test.manifestMediaType, manifest.MediaType)
+			}
+			if manifest.Config.Digest != digest.FromBytes(image.Config) {
+				t.Errorf("Expected the config to stay %s, got %s", digest.FromBytes(image.Config), manifest.Config.Digest)
+			}
+			if len(manifest.Layers) != len(image.Layers) {
+				t.Fatalf("Expected %d layers, got %d", len(image.Layers), len(manifest.Layers))
+			}
+			for i, layer := range manifest.Layers {
+				content, ok := dest.Blob("app", layer.Digest)
+				if !ok {
+					t.Fatalf("Expected the layer %s to be pushed", layer.Digest)
+				}
+				if layer.MediaType != test.layerMediaType || layer.Size != int64(len(content)) || layer.Digest == digest.FromBytes(image.Layers[i]) {
+					t.Errorf("Expected layer %d to be recompressed as %s, got %+v", i, test.layerMediaType, layer)
+				}
+				if diffID := digest.FromBytes(decompress(t, content, test.compression)); diffID != image.DiffIDs[i] {
+					t.Errorf("Expected layer %d to decompress to the diff_id %s, got %s", i, image.DiffIDs[i], diffID)
+				}
+			}
+		})
+	}
+}
+
+func TestRecompressRefusesTamperedLayers(t *testing.T) {
+	t.Run("wrong diff_id", func(t *testing.T) {
+		src := newFakeRegistry(t)
+		dest := newFakeRegistry(t)
+		tarContent := tarLayer(t, map[string]string{"a": "content of a"})
+		wrong := digest.FromBytes(tarLayer(t, map[string]string{"a": "something else"}))
+		src.addImageWithLayers(t, "app", "1.0", []string{schema2.MediaTypeLayer}, [][]byte{gzipBytes(t, tarContent)}, []digest.Digest{wrong})
+
+		options := testCopyOptions()
+		options.Recompress = recompressionZstd
+		_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+		if err == nil || !strings.Contains(err.Error(), "the image config expects "+wrong.String()) {
+			t.Errorf("Expected the diff_id check to fail, got %v", err)
+		}
+		if _, ok := dest.Manifest("app", "1.0"); ok {
+			t.Error("Expected no manifest to be pushed")
+		}
+	})
+
+	t.Run("corrupt blob", func(t *testing.T) {
+		src := newFakeRegistry(t)
+		dest := newFakeRegistry(t)
+		image := src.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+		layerDigest := digest.FromBytes(image.Layers[0])
+		src.lock.Lock()
+		src.blobs["app@"+layerDigest.String()] = gzipBytes(t, tarLayer(t, map[string]string{"a": "tampered"}))
+		src.lock.Unlock()
+
+		options := testCopyOptions()
+		options.Recompress = recompressionZstd
+		_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+		if err == nil || !strings.Contains(err.Error(), "does not match its digest") {
+			t.Errorf("Expected the layer digest check to fail, got %v", err)
+		}
+		if _, ok := dest.Manifest("app", "1.0"); ok {
+			t.Error("Expected no manifest to be pushed")
+		}
+	})
+}
+
+func TestRecompressZstdKeepsUncompressedLayersInOCITypes(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	// Only the gzip layer is recompressed, the other one keeps its
+	// compression but still has to get an OCI media type
+	compressed := tarLayer(t, map[string]string{"a": "content of a"})
+	uncompressed := tarLayer(t, map[string]string{"b": "content of b"})
+	src.addImageWithLayers(t, "app", "1.0", []string{schema2.MediaTypeLayer, dockerTarLayerMediaType}, [][]byte{gzipBytes(t, compressed), uncompressed}, []digest.Digest{digest.FromBytes(compressed), digest.FromBytes(uncompressed)})
+
+	options := testCopyOptions()
+	options.Recompress = recompressionZstd
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied, ok := dest.Manifest("app", "1.0")
+	if !ok {
+		t.Fatal("Expected the manifest to be pushed")
+	}
+	manifest, err := parseRawManifest(copied.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.MediaType != ociManifestMediaType || manifest.Config.MediaType != ociConfigMediaType {
+		t.Errorf("Expected an OCI manifest with an OCI config, got %s with %s", manifest.MediaType, manifest.Config.MediaType)
+	}
+	if len(manifest.Layers) != 2 || manifest.Layers[0].MediaType != ociZstdLayerMediaType || manifest.Layers[1].MediaType != ociTarLayerMediaType {
+		t.Errorf("Expected the layers to become %s and %s, got %+v", ociZstdLayerMediaType, ociTarLayerMediaType, manifest.Layers)
+	}
+}
+
+func TestRecompressRetriesOnlyTheFailedUpload(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	image := src.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+	dest.Handler = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method == "PUT" && strings.Contains(req.URL.Path, "/blobs/uploads/") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	}
+
+	options := testCopyOptions()
+	options.Recompress = recompressionZstd
+	options.LayerRetry = retryPolicy{Retries: 2}
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err == nil {
+		t.Fatal("Expected the copy to fail when every upload fails")
+	}
+
+	downloads := 0
+	for _, request := range src.Requests() {
+		if request == "GET /v2/app/blobs/"+digestOf(image.Layers[0]) {
+			downloads++
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("Expected the layer to be downloaded and recompressed once, got %d downloads", downloads)
+	}
+	uploads := 0
+	for _, request := range dest.Requests() {
+		if strings.HasPrefix(request, "PUT /v2/app/blobs/uploads/") && !strings.Contains(request, digest.FromBytes(image.Config).Hex()) {
+			uploads++
+		}
+	}
+	if uploads != 3 {
+		t.Errorf("Expected the recompressed layer to be uploaded 3 times, got %d", uploads)
+	}
+}
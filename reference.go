@@ -0,0 +1,184 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+const dockerHubURL = "https://registry-1.docker.io"
+
+// dockerHubHosts are the names Docker Hub goes by in image references.
+var dockerHubHosts = map[string]bool{
+	"docker.io":       true,
+	"index.docker.io": true,
+}
+
+// repositoryNamePattern is the repository name grammar of the distribution
+// spec: lowercase path components separated by slashes.
+var repositoryNamePattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+
+const maxRepositoryNameLength = 255
+
+// imageReference is a full image reference like
+// registry.example.com/team/app:1.2.3 split into its parts.
+type imageReference struct {
+	RegistryURL string
+	Repository  string
+	Tag         string
+	Digest      string
+}
+
+// parseImageReference splits a reference the way docker does: the first path
+// component is the registry host only when it looks like one, otherwise the
+// image lives on Docker Hub, as it also does behind docker.io and
+// index.docker.io. An explicit http:// or https:// scheme is kept.
+// Like skopeo, a docker:// prefix names a registry image and dir:// a local
+// image directory, which may be pinned with a trailing @digest. oci:// names
+// a directory in the OCI image layout, which holds images by tag or digest.
+func parseImageReference(ref string) (imageReference, error) {
+	parsed := imageReference{}
+
+	if isDirTransport(ref) {
+		if i := strings.LastIndex(ref, "@"); i >= 0 {
+			if parsedDigest, err := digest.ParseDigest(ref[i+1:]); err == nil {
+				parsed.Digest = parsedDigest.String()
+				ref = ref[:i]
+			}
+		}
+
+		path := strings.TrimPrefix(ref, dirTransportPrefix)
+		if path == "" {
+			return parsed, fmt.Errorf("Missing directory in image reference %s", ref)
+		}
+		parsed.RegistryURL = ref
+		parsed.Repository = filepath.Base(filepath.Clean(path))
+		return parsed, nil
+	}
+
+	if isOCILayoutTransport(ref) {
+		path := strings.TrimPrefix(ref, ociTransportPrefix)
+		if i := strings.LastIndex(path, "@"); i >= 0 {
+			parsedDigest, err := digest.ParseDigest(path[i+1:])
+			if err != nil {
+				return parsed, fmt.Errorf("Invalid digest in image reference %s. %v", ref, err)
+			}
+			parsed.Digest = parsedDigest.String()
+			path = path[:i]
+		} else if i := strings.LastIndex(path, ":"); i >= 0 && !strings.Contains(path[i+1:], "/") {
+			parsed.Tag = path[i+1:]
+			path = path[:i]
+		}
+		if path == "" {
+			return parsed, fmt.Errorf("Missing directory in image reference %s", ref)
+		}
+		parsed.RegistryURL = ociTransportPrefix + path
+		parsed.Repository = filepath.Base(filepath.Clean(path))
+		return parsed, nil
+	}
+
+	remainder := strings.TrimPrefix(ref, dockerTransportPrefix)
+
+	scheme := "https://"
+	hasScheme := false
+	for _, prefix := range []string{"http://", "https://"} {
+		if strings.HasPrefix(remainder, prefix) {
+			scheme = prefix
+			hasScheme = true
+			remainder = strings.TrimPrefix(remainder, prefix)
+		}
+	}
+
+	if i := strings.Index(remainder, "@"); i >= 0 {
+		parsedDigest, err := digest.ParseDigest(remainder[i+1:])
+		if err != nil {
+			return parsed, fmt.Errorf("Invalid digest in image reference %s. %v", ref, err)
+		}
+		parsed.Digest = parsedDigest.String()
+		remainder = remainder[:i]
+	}
+
+	// A colon after the last slash separates the tag, any other colon belongs
+	// to the registry port
+	if i := strings.LastIndex(remainder, ":"); i >= 0 && !strings.Contains(remainder[i+1:], "/") {
+		parsed.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+		if parsed.Tag == "" {
+			return parsed, fmt.Errorf("Empty tag in image reference %s", ref)
+		}
+	}
+
+	parts := strings.SplitN(remainder, "/", 2)
+	if len(parts) == 2 && scheme == "https://" && dockerHubHosts[parts[0]] {
+		// docker.io only names Docker Hub, its registry API is served elsewhere
+		parsed.RegistryURL = dockerHubURL
+		remainder = parts[1]
+		if !strings.Contains(remainder, "/") {
+			remainder = "library/" + remainder
+		}
+	} else if len(parts) == 2 && (hasScheme || strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		parsed.RegistryURL = scheme + parts[0]
+		remainder = parts[1]
+	} else {
+		if hasScheme {
+			return parsed, fmt.Errorf("Missing repository in image reference %s", ref)
+		}
+		parsed.RegistryURL = dockerHubURL
+		if !strings.Contains(remainder, "/") {
+			remainder = "library/" + remainder
+		}
+	}
+
+	if remainder == "" || strings.HasSuffix(remainder, "/") || strings.Contains(remainder, "//") {
+		return parsed, fmt.Errorf("Invalid repository in image reference %s", ref)
+	}
+	parsed.Repository = remainder
+
+	return parsed, nil
+}
+
+// validateRepositoryName rejects repository names no registry accepts, so a
+// typo fails before anything is transferred.
+func validateRepositoryName(repository string) error {
+	if len(repository) > maxRepositoryNameLength {
+		return fmt.Errorf("The repository name %s is longer than %d characters", repository, maxRepositoryNameLength)
+	}
+	if !repositoryNamePattern.MatchString(repository) {
+		return fmt.Errorf("The repository name %s is invalid. Names are made of lowercase letters, digits and the separators '.', '_', '__' and '-', with '/' between path components", repository)
+	}
+	return nil
+}
+
+func repositoryDepth(repository string) int {
+	return strings.Count(repository, "/") + 1
+}
+
+// validateRepositoryDepth rejects repository names with a number of path
+// components the registry is known not to accept. Docker Hub only has
+// <namespace>/<name> repositories, other registries are left to say so.
+func validateRepositoryDepth(registryURL string, repository string) error {
+	switch normalizeRegistryURL(registryURL) {
+	case "registry-1.docker.io", "index.docker.io", "docker.io":
+		if repositoryDepth(repository) != 2 {
+			return fmt.Errorf("Docker Hub repositories are named <namespace>/<name>, but %s has %d path component(s)", repository, repositoryDepth(repository))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected imageReference
+	}{
+		{"alpine", imageReference{RegistryURL: dockerHubURL, Repository: "library/alpine"}},
+		{"alpine:3", imageReference{RegistryURL: dockerHubURL, Repository: "library/alpine", Tag: "3"}},
+		{"octocat/hello:1.0", imageReference{RegistryURL: dockerHubURL, Repository: "octocat/hello", Tag: "1.0"}},
+		{"docker.io/library/alpine:3", imageReference{RegistryURL: dockerHubURL, Repository: "library/alpine", Tag: "3"}},
+		{"docker.io/alpine:3", imageReference{RegistryURL: dockerHubURL, Repository: "library/alpine", Tag: "3"}},
+		{"index.docker.io/library/alpine:3", imageReference{RegistryURL: dockerHubURL, Repository: "library/alpine", Tag: "3"}},
+		{"index.docker.io/alpine", imageReference{RegistryURL: dockerHubURL, Repository: "library/alpine"}},
+		{"docker://docker.io/octocat/hello:1.0", imageReference{RegistryURL: dockerHubURL, Repository: "octocat/hello", Tag: "1.0"}},
+		{"localhost:5000/app:1.0", imageReference{RegistryURL: "https://localhost:5000", Repository: "app", Tag: "1.0"}},
+		{"http://registry.example.com/team/app", imageReference{RegistryURL: "http://registry.example.com", Repository: "team/app"}},
+	}
+	for _, test := range tests {
+		parsed, err := parseImageReference(test.ref)
+		if err != nil {
+			t.Errorf("Expected %s to parse, got %v", test.ref, err)
+			continue
+		}
+		if parsed != test.expected {
+			t.Errorf("Expected %s to parse as %+v, got %+v", test.ref, test.expected, parsed)
+		}
+	}
+}
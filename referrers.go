@@ -0,0 +1,222 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+var nextLinkPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="?next"?`)
+
+// getReferrers lists the artifacts, like signatures or SBOMs, that name the
+// manifest with the given digest as their subject. Registries without the
+// OCI referrers API keep them in an index tagged after the digest instead.
+func getReferrers(hub *registry.Registry, repository string, subject digest.Digest) ([]descriptor, error) {
+	url := fmt.Sprintf("%s/v2/%s/referrers/%s", hub.URL, repository, subject)
+	referrers := []descriptor{}
+	for url != "" {
+		hub.Logf("registry.referrers url=%s repository=%s digest=%s", url, repository, subject)
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", ociIndexMediaType)
+
+		resp, err := hub.Client.Do(req)
+		if err != nil {
+			if httpErr := httpStatusError(err); httpErr != nil && httpErr.Response.StatusCode == http.StatusNotFound && len(referrers) == 0 {
+				return getReferrersFromTag(hub, repository, subject)
+			}
+			return nil, err
+		}
+
+		var index rawManifest
+		err = json.NewDecoder(resp.Body).Decode(&index)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		referrers = append(referrers, index.Manifests...)
+
+		url = ""
+		if match := nextLinkPattern.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			next, err := resp.Request.URL.Parse(match[1])
+			if err != nil {
+				return nil, err
+			}
+			url = next.String()
+		}
+	}
+	return referrers, nil
+}
+
+// hasReferrersAPI tells whether a registry serves the OCI referrers API.
+// Registries without it answer 404 for any subject.
+func hasReferrersAPI(hub *registry.Registry, repository string, subject digest.Digest) (bool, error) {
+	url := fmt.Sprintf("%s/v2/%s/referrers/%s", hub.URL, repository, subject)
+	hub.Logf("registry.referrers url=%s repository=%s digest=%s", url, repository, subject)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", ociIndexMediaType)
+
+	resp, err := hub.Client.Do(req)
+	if err != nil {
+		if httpErr := httpStatusError(err); httpErr != nil && httpErr.Response.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// referrersTag is the tag of the referrers tag schema that holds the
+// referrers of a subject.
+func referrersTag(subject digest.Digest) string {
+	return strings.Replace(subject.String(), ":", "-", 1)
+}
+
+// tagReferrers makes copied referrers discoverable in a destination without
+// the referrers API, by adding them to the index of the referrers tag
+// schema. Registries with the API find them through their subject.
+func tagReferrers(hub *registry.Registry, repository string, subject digest.Digest, referrers []descriptor) error {
+	supported, err := hasReferrersAPI(hub, repository, subject)
+	if err != nil || supported {
+		return err
+	}
+
+	existing, err := getReferrersFromTag(hub, repository, subject)
+	if err != nil {
+		return err
+	}
+	manifests := existing
+	known := map[digest.Digest]bool{}
+	for _, referrer := range existing {
+		known[referrer.Digest] = true
+	}
+	for _, referrer := range referrers {
+		if !known[referrer.Digest] {
+			manifests = append(manifests, referrer)
+			known[referrer.Digest] = true
+		}
+	}
+	if len(manifests) == len(existing) {
+		return nil
+	}
+
+	content, err := marshalJSON(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociIndexMediaType,
+		"manifests":     manifests,
+	})
+	if err != nil {
+		return err
+	}
+	tag := referrersTag(subject)
+	fmt.Printf("The destination has no referrers API, listing %d referrer(s) in the tag %s\n", len(manifests), tag)
+	return putManifest(hub, repository, tag, ociIndexMediaType, content)
+}
+
+// getReferrersFromTag reads the referrers from the sha256-<hex> tag of the
+// referrers tag schema.
+func getReferrersFromTag(hub *registry.Registry, repository string, subject digest.Digest) ([]descriptor, error) {
+	tag := referrersTag(subject)
+	content, mediaType, err := getManifest(hub, repository, tag, []string{ociIndexMediaType})
+	if isManifestUnknown(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != ociIndexMediaType {
+		return nil, nil
+	}
+
+	index, err := parseRawManifest(content)
+	if err != nil {
+		return nil, err
+	}
+	return index.Manifests, nil
+}
+
+// copyReferrers copies every artifact referring to the manifest with the
+// given digest, and in turn the artifacts referring to those. They are
+// pushed by digest, which keeps their subject valid in the destination, and
+// listed in the referrers tag when the destination has no referrers API.
+func copyReferrers(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, destRepo string, subject digest.Digest, options copyOptions) error {
+	referrers, err := getReferrers(srcHub, srcRepo, subject)
+	if err != nil {
+		return withExitCode(err, exitTransfer, fmt.Errorf("Failed to list the referrers of %s/%s@%s. %v", srcHub.URL, srcRepo, subject, err))
+	}
+
+	for _, referrer := range referrers {
+		fmt.Printf("Copying referrer %s of type %s\n", referrer.Digest, referrer.ArtifactType)
+		_, err = copyImage(srcHub, destHub, srcRepo, referrer.Digest.String(), destRepo, referrer.Digest.String(), options)
+		if err != nil {
+			return err
+		}
+		err = copyReferrers(srcHub, destHub, srcRepo, destRepo, referrer.Digest, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(referrers) == 0 || options.DryRun || isDirTransport(destHub.URL) || isOCILayoutTransport(destHub.URL) {
+		return nil
+	}
+	err = tagReferrers(destHub, destRepo, subject, referrers)
+	if err != nil {
+		return withExitCode(err, exitTransfer, fmt.Errorf("Failed to list the referrers of %s/%s@%s in the referrers tag. %v", destHub.URL, destRepo, subject, err))
+	}
+	return nil
+}
+
+// copyImageAndReferrers copies an image and, when asked to, the artifacts
+// referring to it. The referrers name the source manifest as their subject,
+// so they are only copied when the manifest was copied unchanged.
+func copyImageAndReferrers(srcHub *registry.Registry, destHub *registry.Registry, srcRepo string, srcRef string, destRepo string, destRef string, options copyOptions) (descriptor, error) {
+	source, err := copyImage(srcHub, destHub, srcRepo, srcRef, destRepo, destRef, options)
+	if err != nil || !options.CopyReferrers {
+		return source, err
+	}
+
+	if isSchema1MediaType(source.MediaType) {
+		fmt.Println("schema1 manifests have no referrers, nothing else to copy")
+		return source, nil
+	}
+	if isDirTransport(srcHub.URL) {
+		fmt.Println("Image directories hold no referrers, nothing else to copy")
+		return source, nil
+	}
+
+	// The referrers are artifacts of any kind, and they are copied whole
+	referrerOptions := options
+	referrerOptions.Artifact = true
+	referrerOptions.AllPlatforms = true
+	referrerOptions.Since = time.Time{}
+	return source, copyReferrers(srcHub, destHub, srcRepo, destRepo, source.Digest, referrerOptions)
+}
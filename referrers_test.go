@@ -0,0 +1,156 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+// addSignature pushes an artifact naming the manifest as its subject, and
+// serves it from the referrers API.
+func (r *fakeRegistry) addSignature(t *testing.T, repository string, subject digest.Digest) digest.Digest {
+	config := []byte("{}")
+	signature := []byte("signature of " + subject.String())
+	content := jsonBytes(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestMediaType,
+		"artifactType":  "application/vnd.example.signature",
+		"config":        map[string]interface{}{"mediaType": "application/vnd.oci.empty.v1+json", "size": len(config), "digest": r.AddBlob(repository, config)},
+		"layers":        []interface{}{map[string]interface{}{"mediaType": "application/octet-stream", "size": len(signature), "digest": r.AddBlob(repository, signature)}},
+		"subject":       map[string]interface{}{"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": subject},
+	})
+	signatureDigest := r.AddManifest(repository, digest.FromBytes(content).String(), ociManifestMediaType, content)
+
+	index := jsonBytes(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociIndexMediaType,
+		"manifests": []interface{}{map[string]interface{}{
+			"mediaType":    ociManifestMediaType,
+			"artifactType": "application/vnd.example.signature",
+			"size":         len(content),
+			"digest":       signatureDigest,
+		}},
+	})
+	previous := r.Handler
+	r.Handler = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.URL.Path == "/v2/"+repository+"/referrers/"+subject.String() {
+			w.Header().Set("Content-Type", ociIndexMediaType)
+			w.Write(index)
+			return true
+		}
+		return previous != nil && previous(w, req)
+	}
+	return signatureDigest
+}
+
+func TestReferrersOfTheCopiedManifest(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	image := src.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+	signature := src.addSignature(t, "app", image.Digest)
+
+	// The tag moves to another image right after the copy fetched it
+	src.Handler = func(previous func(http.ResponseWriter, *http.Request) bool) func(http.ResponseWriter, *http.Request) bool {
+		return func(w http.ResponseWriter, req *http.Request) bool {
+			if req.Method == "GET" && req.URL.Path == "/v2/app/manifests/1.0" {
+				manifest, _ := src.Manifest("app", "1.0")
+				src.addTestImage(t, "app", "1.0", nil, []string{"b"}, nil)
+				w.Header().Set("Content-Type", manifest.MediaType)
+				w.Write(manifest.Content)
+				return true
+			}
+			return previous(w, req)
+		}
+	}(src.Handler)
+
+	options := testCopyOptions()
+	options.CopyReferrers = true
+	source, err := copyImageAndReferrers(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if source.Digest != image.Digest {
+		t.Errorf("Expected the copy to return the digest %s, got %s", image.Digest, source.Digest)
+	}
+	if _, ok := dest.Manifest("app", signature.String()); !ok {
+		t.Error("Expected the signature of the copied manifest to be copied")
+	}
+	fetches := 0
+	for _, request := range src.Requests() {
+		if strings.HasPrefix(request, "GET /v2/app/manifests/1.0") {
+			fetches++
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Expected the source manifest to be fetched once, got %d", fetches)
+	}
+}
+
+func TestReferrersTagInDestinationWithoutReferrersAPI(t *testing.T) {
+	for _, destHasAPI := range []bool{false, true} {
+		src := newFakeRegistry(t)
+		dest := newFakeRegistry(t)
+		image := src.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+		signature := src.addSignature(t, "app", image.Digest)
+		tag := strings.Replace(image.Digest.String(), ":", "-", 1)
+
+		// The destination already lists another referrer in the tag
+		other := digest.FromBytes([]byte("other referrer"))
+		dest.AddManifest("app", tag, ociIndexMediaType, jsonBytes(t, map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     ociIndexMediaType,
+			"manifests":     []interface{}{map[string]interface{}{"mediaType": ociManifestMediaType, "size": 10, "digest": other}},
+		}))
+		if destHasAPI {
+			dest.Handler = func(w http.ResponseWriter, req *http.Request) bool {
+				if strings.HasPrefix(req.URL.Path, "/v2/app/referrers/") {
+					w.Header().Set("Content-Type", ociIndexMediaType)
+					w.Write([]byte(`{"schemaVersion": 2, "mediaType": "` + ociIndexMediaType + `", "manifests": []}`))
+					return true
+				}
+				return false
+			}
+		}
+
+		options := testCopyOptions()
+		options.CopyReferrers = true
+		_, err := copyImageAndReferrers(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		referrers, err := getReferrersFromTag(dest.Hub(t), "app", image.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed := []digest.Digest{}
+		for _, referrer := range referrers {
+			listed = append(listed, referrer.Digest)
+		}
+		expected := []digest.Digest{other, signature}
+		if destHasAPI {
+			expected = []digest.Digest{other}
+		}
+		if !reflect.DeepEqual(listed, expected) {
+			t.Errorf("Expected the referrers tag of a destination with the API %v to list %v, got %v", destHasAPI, expected, listed)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// The registry client does not cover every endpoint of the registry API, the
+// helpers below fill in the missing ones on top of its authenticated client.
+
+func deleteBlob(hub *registry.Registry, repository string, blobDigest digest.Digest) error {
+	url := fmt.Sprintf("%s/v2/%s/blobs/%s", hub.URL, repository, blobDigest)
+	hub.Logf("registry.blob.delete url=%s repository=%s digest=%s", url, repository, blobDigest)
+
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hub.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
+
+// mountBlob asks the registry to link a blob from another repository into
+// repository without transferring it. It returns false when the registry
+// answers with a fresh upload session instead, which it does when it doesn't
+// support mounting or can't find the blob in the other repository.
+func mountBlob(hub *registry.Registry, repository string, fromRepository string, blobDigest digest.Digest) (bool, error) {
+	url := fmt.Sprintf("%s/v2/%s/blobs/uploads/?mount=%s&from=%s", hub.URL, repository, blobDigest, fromRepository)
+	hub.Logf("registry.blob.mount url=%s repository=%s from=%s digest=%s", url, repository, fromRepository, blobDigest)
+
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := hub.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	// Some registries answer with the location of the blob in another
+	// repository, which doesn't make it available in this one
+	if resp.StatusCode == http.StatusCreated {
+		location := resp.Header.Get("Location")
+		return location == "" || isBlobLocation(resp.Request.URL, location, repository, blobDigest), nil
+	}
+
+	// Don't leave the upload session the registry started lying around
+	cancelUpload(hub, resp)
+	return false, nil
+}
+
+// isBlobLocation tells whether a Location header points at a blob in the
+// given repository.
+func isBlobLocation(base *neturl.URL, location string, repository string, blobDigest digest.Digest) bool {
+	parsed, err := base.Parse(location)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(parsed.Path, fmt.Sprintf("/v2/%s/blobs/%s", repository, blobDigest))
+}
+
+// checkPushPermission starts an upload to repository and cancels it right
+// away, which only succeeds with the permission to push.
+func checkPushPermission(hub *registry.Registry, repository string) error {
+	url := fmt.Sprintf("%s/v2/%s/blobs/uploads/", hub.URL, repository)
+	hub.Logf("registry.blob.check-push url=%s repository=%s", url, repository)
+
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hub.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	cancelUpload(hub, resp)
+	return nil
+}
+
+// checkDestinationRepository probes the destination repository for push
+// permission right after connecting and explains the common reasons a
+// registry refuses it, rather than failing on the first layer upload.
+func checkDestinationRepository(hub *registry.Registry, repository string) error {
+	err := checkPushPermission(hub, repository)
+	if err == nil {
+		return nil
+	}
+
+	httpErr := httpStatusError(err)
+	if httpErr == nil {
+		return fmt.Errorf("Failed to check the destination repository %s. %v", repository, err)
+	}
+
+	body := string(httpErr.Body)
+	switch {
+	case httpErr.Response.StatusCode == http.StatusUnauthorized || httpErr.Response.StatusCode == http.StatusForbidden:
+		return &exitError{Code: exitAuth, Err: fmt.Errorf("Not allowed to push to the destination repository %s. %v", repository, err)}
+	case strings.Contains(body, "NAME_INVALID"):
+		return &exitError{Code: exitUsage, Err: fmt.Errorf("The destination registry rejected the repository name %s. %v", repository, err)}
+	case strings.Contains(body, "NAME_UNKNOWN") || httpErr.Response.StatusCode == http.StatusNotFound:
+		return &exitError{Code: exitUsage, Err: fmt.Errorf("The destination repository %s does not exist and can not be created, check that its project or namespace exists. %v", repository, err)}
+	}
+	return fmt.Errorf("Failed to check the destination repository %s. %v", repository, err)
+}
+
+// cancelUpload deletes the upload session a response points at, ignoring any
+// failure as the registry expires abandoned uploads anyway.
+func cancelUpload(hub *registry.Registry, resp *http.Response) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return
+	}
+	cancelURL, err := resp.Request.URL.Parse(location)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("DELETE", cancelURL.String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err = hub.Client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+var errRangeNotSupported = errors.New("Range requests are not supported")
+
+// downloadBlobInSegments downloads a blob into file as parallel byte ranges
+// and verifies the reassembled content. Each segment is retried on its own
+// with the given policy. It returns false without an error when the registry
+// ignores range requests, leaving the caller to download the blob at once.
+func downloadBlobInSegments(hub *registry.Registry, repository string, blobDigest digest.Digest, file *os.File, segments int, policy retryPolicy) (bool, error) {
+	metadata, err := hub.LayerMetadata(repository, blobDigest)
+	if err != nil {
+		return false, err
+	}
+	size := metadata.Size
+	if size <= 0 {
+		return false, nil
+	}
+
+	url := fmt.Sprintf("%s/v2/%s/blobs/%s", hub.URL, repository, blobDigest)
+	segmentSize := (size + int64(segments) - 1) / int64(segments)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, segments)
+	for start := int64(0); start < size; start += segmentSize {
+		end := start + segmentSize - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		wg.Add(1)
+		go func(start int64, end int64) {
+			defer wg.Done()
+			what := fmt.Sprintf("Downloading bytes %d-%d of layer %s", start, end, blobDigest)
+			errs <- retryTransient(what, policy, func() error {
+				return downloadBlobRange(hub, url, file, start, end)
+			})
+		}(start, end)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err == errRangeNotSupported {
+			return false, file.Truncate(0)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	verifier, err := digest.NewDigestVerifier(blobDigest)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(verifier, io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return false, err
+	}
+	if !verifier.Verified() {
+		return false, fmt.Errorf("The reassembled segments of %s do not match its digest", blobDigest)
+	}
+
+	_, err = file.Seek(size, io.SeekStart)
+	return true, err
+}
+
+func downloadBlobRange(hub *registry.Registry, url string, file *os.File, start int64, end int64) error {
+	hub.Logf("registry.blob.download-range url=%s range=%d-%d", url, start, end)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := hub.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return errRangeNotSupported
+	}
+
+	length := end - start + 1
+	written, err := io.CopyN(&offsetWriter{File: file, Offset: start}, resp.Body, length)
+	if err != nil {
+		return err
+	}
+	if written != length {
+		return fmt.Errorf("Expected %d bytes for range %d-%d but got %d", length, start, end, written)
+	}
+	return nil
+}
+
+// offsetWriter writes sequentially into a file starting at an offset, without
+// moving the file's own position, so several ranges can be written at once.
+type offsetWriter struct {
+	File   *os.File
+	Offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.File.WriteAt(p, w.Offset)
+	w.Offset += int64(n)
+	return n, err
+}
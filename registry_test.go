@@ -0,0 +1,671 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/libtrust"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// fakeRegistry is an in-memory registry serving the parts of the registry API
+// the copy uses. Blobs and manifests are kept per repository.
+type fakeRegistry struct {
+	*httptest.Server
+	// Prefix is the path the API is served under, like a registry behind
+	// Artifactory
+	Prefix string
+	// AbsoluteLocation makes upload locations absolute URLs instead of paths
+	AbsoluteLocation bool
+	// Username and Password are required with basic auth, or to get a token
+	// when Bearer is set. An empty Username accepts any username.
+	Username string
+	Password string
+	Bearer   bool
+	// Handler is asked first and handles the request when it returns true
+	Handler func(w http.ResponseWriter, req *http.Request) bool
+
+	lock      sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]fakeManifest
+	requests  []string
+	scopes    []string
+	uploads   int
+}
+
+type fakeManifest struct {
+	MediaType string
+	Content   []byte
+}
+
+const fakeToken = "fake-token"
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string]fakeManifest{},
+	}
+	r.Server = httptest.NewServer(r)
+	t.Cleanup(r.Close)
+	return r
+}
+
+// BaseURL is the URL the registry is reached at, including its prefix.
+func (r *fakeRegistry) BaseURL() string {
+	return r.URL + r.Prefix
+}
+
+// Hub connects to the registry the way the tool does, with the credentials
+// the registry expects.
+func (r *fakeRegistry) Hub(t *testing.T) *registry.Registry {
+	args := testArguments("test", r.BaseURL(), "", "")
+	*args.Username = r.Username
+	*args.Password = r.Password
+	hub, err := connectToRegistry(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.Logf = registry.Quiet
+	return hub
+}
+
+func (r *fakeRegistry) AddBlob(repository string, content []byte) digest.Digest {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	blobDigest := digest.FromBytes(content)
+	r.blobs[repository+"@"+blobDigest.String()] = content
+	return blobDigest
+}
+
+func (r *fakeRegistry) Blob(repository string, blobDigest digest.Digest) ([]byte, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	content, ok := r.blobs[repository+"@"+blobDigest.String()]
+	return content, ok
+}
+
+func (r *fakeRegistry) AddManifest(repository string, reference string, mediaType string, content []byte) digest.Digest {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	manifestDigest := fakeManifestDigest(content, mediaType)
+	r.manifests[repository+":"+reference] = fakeManifest{MediaType: mediaType, Content: content}
+	r.manifests[repository+"@"+manifestDigest.String()] = fakeManifest{MediaType: mediaType, Content: content}
+	return manifestDigest
+}
+
+func (r *fakeRegistry) Manifest(repository string, reference string) (fakeManifest, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	manifest, ok := r.manifests[manifestKey(repository, reference)]
+	return manifest, ok
+}
+
+// Requests lists the requests received so far as "METHOD path?query".
+func (r *fakeRegistry) Requests() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.requests...)
+}
+
+// Scopes lists the scopes tokens were asked for.
+func (r *fakeRegistry) Scopes() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.scopes...)
+}
+
+// fakeManifestDigest identifies a signed schema1 manifest by its payload,
+// like a registry does.
+func fakeManifestDigest(content []byte, mediaType string) digest.Digest {
+	var signed schema1.SignedManifest
+	if mediaType == schema1.MediaTypeSignedManifest && signed.UnmarshalJSON(content) == nil {
+		return digest.FromBytes(signed.Canonical)
+	}
+	return digest.FromBytes(content)
+}
+
+func manifestKey(repository string, reference string) string {
+	if _, err := digest.ParseDigest(reference); err == nil {
+		return repository + "@" + reference
+	}
+	return repository + ":" + reference
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.RequestURI())
+	r.lock.Unlock()
+
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+	if !r.authorized(w, req) {
+		return
+	}
+	if r.Handler != nil && r.Handler(w, req) {
+		return
+	}
+
+	if !strings.HasPrefix(req.URL.Path, r.Prefix+"/v2/") {
+		http.NotFound(w, req)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, r.Prefix+"/v2/")
+	if path == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/uploads/"); i >= 0 {
+		r.serveUpload(w, req, path[:i], path[i+len("/blobs/uploads/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		r.serveBlob(w, req, path[:i], path[i+len("/blobs/"):])
+		return
+	}
+	if strings.HasSuffix(path, "/tags/list") {
+		r.serveTags(w, strings.TrimSuffix(path, "/tags/list"))
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// authorized checks the credentials of a request and answers with a
+// challenge when they are missing.
+func (r *fakeRegistry) authorized(w http.ResponseWriter, req *http.Request) bool {
+	if r.Password == "" {
+		return true
+	}
+	authorization := req.Header.Get("Authorization")
+	if r.Bearer {
+		if authorization == "Bearer "+fakeToken {
+			return true
+		}
+		challenge := fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, r.URL)
+		path := strings.TrimPrefix(req.URL.Path, r.Prefix+"/v2/")
+		for _, marker := range []string{"/manifests/", "/blobs/", "/tags/"} {
+			if i := strings.Index(path, marker); i >= 0 {
+				challenge += fmt.Sprintf(`,scope="repository:%s:pull,push"`, path[:i])
+				break
+			}
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+	} else {
+		if r.checkBasicAuth(authorization) {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprint(w, `{"errors":[{"code":"UNAUTHORIZED"}]}`)
+	return false
+}
+
+func (r *fakeRegistry) checkBasicAuth(authorization string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "Basic "))
+	if err != nil || !strings.HasPrefix(authorization, "Basic ") {
+		return false
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	return len(parts) == 2 && (r.Username == "" || parts[0] == r.Username) && parts[1] == r.Password
+}
+
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	r.scopes = append(r.scopes, req.URL.Query().Get("scope"))
+	r.lock.Unlock()
+
+	if !r.checkBasicAuth(req.Header.Get("Authorization")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	fmt.Fprintf(w, `{"token":"%s"}`, fakeToken)
+}
+
+func (r *fakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repository string, reference string) {
+	switch req.Method {
+	case "GET", "HEAD":
+		manifest, ok := r.Manifest(repository, reference)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`)
+			return
+		}
+		w.Header().Set("Content-Type", manifest.MediaType)
+		w.Header().Set("Docker-Content-Digest", fakeManifestDigest(manifest.Content, manifest.MediaType).String())
+		w.Header().Set("Content-Length", fmt.Sprint(len(manifest.Content)))
+		if req.Method == "GET" {
+			w.Write(manifest.Content)
+		}
+	case "PUT":
+		content, _ := ioutil.ReadAll(req.Body)
+		manifestDigest := r.AddManifest(repository, reference, req.Header.Get("Content-Type"), content)
+		w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		r.lock.Lock()
+		deleted := false
+		for key, manifest := range r.manifests {
+			if strings.HasPrefix(key, repository+":") || strings.HasPrefix(key, repository+"@") {
+				if fakeManifestDigest(manifest.Content, manifest.MediaType).String() == reference {
+					delete(r.manifests, key)
+					deleted = true
+				}
+			}
+		}
+		r.lock.Unlock()
+		if !deleted {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) serveBlob(w http.ResponseWriter, req *http.Request, repository string, reference string) {
+	blobDigest, err := digest.ParseDigest(reference)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	content, ok := r.Blob(repository, blobDigest)
+	switch req.Method {
+	case "GET", "HEAD":
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"BLOB_UNKNOWN"}]}`)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", blobDigest.String())
+		if req.Method == "GET" && req.Header.Get("Range") != "" {
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if req.Method == "GET" {
+			w.Write(content)
+		}
+	case "DELETE":
+		r.lock.Lock()
+		delete(r.blobs, repository+"@"+blobDigest.String())
+		r.lock.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repository string, uploadID string) {
+	switch {
+	case req.Method == "POST" && uploadID == "":
+		query := req.URL.Query()
+		if mount, err := digest.ParseDigest(query.Get("mount")); err == nil && query.Get("from") != "" {
+			if content, ok := r.Blob(query.Get("from"), mount); ok {
+				r.AddBlob(repository, content)
+				w.Header().Set("Location", fmt.Sprintf("%s/v2/%s/blobs/%s", r.Prefix, repository, mount))
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+
+		r.lock.Lock()
+		r.uploads++
+		location := fmt.Sprintf("%s/v2/%s/blobs/uploads/%d", r.Prefix, repository, r.uploads)
+		r.lock.Unlock()
+		if r.AbsoluteLocation {
+			location = r.URL + location
+		}
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == "PUT" && uploadID != "":
+		content, _ := ioutil.ReadAll(req.Body)
+		expected, err := digest.ParseDigest(req.URL.Query().Get("digest"))
+		if err != nil || digest.FromBytes(content) != expected {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID"}]}`)
+			return
+		}
+		r.AddBlob(repository, content)
+		w.Header().Set("Docker-Content-Digest", expected.String())
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == "DELETE" && uploadID != "":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) serveTags(w http.ResponseWriter, repository string) {
+	r.lock.Lock()
+	tags := []string{}
+	for key := range r.manifests {
+		if strings.HasPrefix(key, repository+":") {
+			tags = append(tags, strings.TrimPrefix(key, repository+":"))
+		}
+	}
+	r.lock.Unlock()
+	sort.Strings(tags)
+
+	content, _ := json.Marshal(map[string]interface{}{"name": repository, "tags": tags})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+// testArguments are the arguments of one side of a copy, as if it was given
+// on the command line with the URL of the registry and no other flag.
+func testArguments(prefix string, url string, repository string, tag string) RepositoryArguments {
+	str := func(value string) *string { return &value }
+	anonymous := false
+	maxConns := 0
+	headers := map[string]string{}
+	return RepositoryArguments{
+		Prefix:      prefix,
+		Description: prefix,
+		RegistryURL: str(url),
+		Repository:  str(repository),
+		Tag:         str(tag),
+		Digest:      str(""),
+		Username:    str(""),
+		Password:    str(""),
+		Anonymous:   &anonymous,
+		Auth:        str("auto"),
+		UserAgent:   str(""),
+		Headers:     &headers,
+		MaxConns:    &maxConns,
+		ClientCert:  str(""),
+		ClientKey:   str(""),
+		OCIDir:      str(""),
+	}
+}
+
+// jsonBytes encodes a value for a test fixture, failing the test if it can't.
+func jsonBytes(t *testing.T, value interface{}) []byte {
+	content, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// testImage is a schema2 image with gzip compressed layers, as pushed by
+// docker.
+type testImage struct {
+	Manifest []byte
+	Digest   digest.Digest
+	Config   []byte
+	Layers   [][]byte
+	DiffIDs  []digest.Digest
+}
+
+// tarLayer builds an uncompressed layer holding one file per entry.
+func tarLayer(t *testing.T, files map[string]string) []byte {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	for _, name := range names {
+		err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))})
+		if err == nil {
+			_, err = writer.Write([]byte(files[name]))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func gzipBytes(t *testing.T, content []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write(content)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// addTestImage pushes an image with the given labels and one layer per file
+// to the registry. extra is merged into the manifest, to add fields like
+// annotations.
+func (r *fakeRegistry) addTestImage(t *testing.T, repository string, tag string, labels map[string]string, files []string, extra map[string]interface{}) testImage {
+	image := testImage{}
+	layers := []map[string]interface{}{}
+	for _, file := range files {
+		tarContent := tarLayer(t, map[string]string{file: "content of " + file})
+		layer := gzipBytes(t, tarContent)
+		image.Layers = append(image.Layers, layer)
+		image.DiffIDs = append(image.DiffIDs, digest.FromBytes(tarContent))
+		layers = append(layers, map[string]interface{}{
+			"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+			"size":      len(layer),
+			"digest":    r.AddBlob(repository, layer),
+		})
+	}
+
+	image.Config = jsonBytes(t, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Labels": labels},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": image.DiffIDs},
+	})
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.docker.container.image.v1+json",
+			"size":      len(image.Config),
+			"digest":    r.AddBlob(repository, image.Config),
+		},
+		"layers": layers,
+	}
+	for key, value := range extra {
+		manifest[key] = value
+	}
+	image.Manifest = jsonBytes(t, manifest)
+	image.Digest = r.AddManifest(repository, tag, "application/vnd.docker.distribution.manifest.v2+json", image.Manifest)
+	return image
+}
+
+// testCopyOptions are the options of a copy without any flag.
+func testCopyOptions() copyOptions {
+	return copyOptions{
+		TempPrefix:      "copy-docker-image-test",
+		MemoryThreshold: 1024 * 1024,
+		MountLayers:     true,
+	}
+}
+
+func digestOf(content []byte) string {
+	return digest.FromBytes(content).String()
+}
+
+func TestMountFallsBackToUpload(t *testing.T) {
+	tests := []struct {
+		name   string
+		reject func(w http.ResponseWriter, req *http.Request)
+	}{
+		{"accepted without a location", func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}},
+		{"unknown blob", func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"BLOB_UNKNOWN"}]}`)
+		}},
+		{"bad request", func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}},
+		{"mounted to another repository", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Location", "/v2/elsewhere/app/blobs/"+req.URL.Query().Get("mount"))
+			w.WriteHeader(http.StatusCreated)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeRegistry(t)
+			image := fake.addTestImage(t, "team/app", "1.0", nil, []string{"a", "b"}, nil)
+			mounts := 0
+			fake.Handler = func(w http.ResponseWriter, req *http.Request) bool {
+				if req.Method != "POST" || req.URL.Query().Get("mount") == "" {
+					return false
+				}
+				mounts++
+				test.reject(w, req)
+				return true
+			}
+
+			hub := fake.Hub(t)
+			_, err := copyImage(hub, hub, "team/app", "1.0", "mirror/app", "1.0", testCopyOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if mounts != 3 {
+				t.Errorf("Expected a mount to be tried for the config and both layers, got %d", mounts)
+			}
+			for _, layer := range append(image.Layers, image.Config) {
+				if _, ok := fake.Blob("mirror/app", digest.FromBytes(layer)); !ok {
+					t.Errorf("Expected blob %s to be uploaded", digest.FromBytes(layer))
+				}
+			}
+			if _, ok := fake.Manifest("mirror/app", "1.0"); !ok {
+				t.Error("Expected the manifest to be pushed")
+			}
+		})
+	}
+}
+
+func TestMountBlob(t *testing.T) {
+	fake := newFakeRegistry(t)
+	image := fake.addTestImage(t, "team/app", "1.0", nil, []string{"a"}, nil)
+
+	hub := fake.Hub(t)
+	_, err := copyImage(hub, hub, "team/app", "1.0", "mirror/app", "1.0", testCopyOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range fake.Requests() {
+		if strings.HasPrefix(request, "PUT /v2/mirror/app/blobs/") {
+			t.Errorf("Expected every blob to be mounted, got %s", request)
+		}
+	}
+	if _, ok := fake.Blob("mirror/app", digest.FromBytes(image.Layers[0])); !ok {
+		t.Error("Expected the layer to be mounted")
+	}
+}
+
+// addSchema1Image pushes a signed schema1 manifest with one layer per file
+// to the registry.
+func (r *fakeRegistry) addSchema1Image(t *testing.T, repository string, tag string, files []string) []byte {
+	manifest := schema1.Manifest{Name: repository, Tag: tag, Architecture: "amd64"}
+	manifest.SchemaVersion = 1
+	for _, file := range files {
+		layer := gzipBytes(t, tarLayer(t, map[string]string{file: "content of " + file}))
+		manifest.FSLayers = append(manifest.FSLayers, schema1.FSLayer{BlobSum: r.AddBlob(repository, layer)})
+		manifest.History = append(manifest.History, schema1.History{V1Compatibility: fmt.Sprintf(`{"id":"%s"}`, file)})
+	}
+
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := schema1.Sign(&manifest, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := signed.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddManifest(repository, tag, schema1.MediaTypeSignedManifest, content)
+	return content
+}
+
+// addOCIImage pushes an OCI image with one gzip layer per file. Every
+// descriptor and the manifest itself carry annotations.
+func (r *fakeRegistry) addOCIImage(t *testing.T, repository string, tag string, labels map[string]string, files []string) testImage {
+	image := testImage{}
+	layers := []map[string]interface{}{}
+	for _, file := range files {
+		tarContent := tarLayer(t, map[string]string{file: "content of " + file})
+		layer := gzipBytes(t, tarContent)
+		image.Layers = append(image.Layers, layer)
+		image.DiffIDs = append(image.DiffIDs, digest.FromBytes(tarContent))
+		layers = append(layers, map[string]interface{}{
+			"mediaType":   ociGzipLayerMediaType,
+			"size":        len(layer),
+			"digest":      r.AddBlob(repository, layer),
+			"annotations": map[string]string{"org.opencontainers.image.title": file},
+		})
+	}
+
+	image.Config = jsonBytes(t, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Labels": labels},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": image.DiffIDs},
+	})
+	image.Manifest = jsonBytes(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestMediaType,
+		"config": map[string]interface{}{
+			"mediaType":   ociConfigMediaType,
+			"size":        len(image.Config),
+			"digest":      r.AddBlob(repository, image.Config),
+			"annotations": map[string]string{"com.example.config": "kept"},
+		},
+		"layers": layers,
+		"annotations": map[string]string{
+			"org.opencontainers.image.revision": "0123abc",
+			"org.opencontainers.image.source":   "https://git.example.com/app?ref=main&build=<42>",
+		},
+	})
+	image.Digest = r.AddManifest(repository, tag, ociManifestMediaType, image.Manifest)
+	return image
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sync"
+	"time"
+)
+
+// retryPolicy describes how often an operation is retried and how long to
+// wait in between. No retry waits past the Deadline, if any.
+type retryPolicy struct {
+	Retries  int
+	Delay    time.Duration
+	MaxDelay time.Duration
+	Deadline context.Context
+}
+
+var (
+	jitterLock sync.Mutex
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Backoff returns how long to wait before the given retry, counting from 0.
+// The delay doubles with every retry up to MaxDelay and the actual wait is
+// picked at random below that ("full jitter"), so that many copies retrying
+// against the same recovering registry don't do so in lockstep.
+func (p retryPolicy) Backoff(retry int) time.Duration {
+	delay := p.Delay
+	for i := 0; i < retry && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return time.Duration(jitter.Int63n(int64(delay) + 1))
+}
+
+// wait sleeps for delay and tells whether the operation may be tried again,
+// which it may not once the deadline passed during the wait.
+func (p retryPolicy) wait(delay time.Duration) bool {
+	if p.Deadline == nil {
+		time.Sleep(delay)
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-p.Deadline.Done():
+		return false
+	}
+}
+
+// retryOnManifestUnknown calls fetch until it succeeds, fails for another
+// reason than an unknown manifest or runs out of retries.
+func retryOnManifestUnknown(repository string, tag string, policy retryPolicy, fetch func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fetch()
+		if err == nil || attempt >= policy.Retries || !isManifestUnknown(err) {
+			return err
+		}
+
+		delay := policy.Backoff(attempt)
+		fmt.Printf("Manifest for %s:%s is not known yet, retrying in %v\n", repository, tag, delay)
+		if !policy.wait(delay) {
+			return err
+		}
+	}
+}
+
+// retryTransient calls op until it succeeds, fails for a reason a retry
+// won't fix or runs out of retries. what names the operation in the
+// messages printed before every retry.
+func retryTransient(what string, policy retryPolicy, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= policy.Retries || !isTransientError(err) {
+			return err
+		}
+
+		delay := policy.Backoff(attempt)
+		fmt.Printf("%s failed, retrying in %v. %v\n", what, delay, err)
+		if !policy.wait(delay) {
+			return err
+		}
+	}
+}
+
+// isTransientError tells whether an error of a registry request may go away
+// on its own: the registry being overloaded or failing internally, or the
+// connection breaking down. An expired --deadline is not transient.
+func isTransientError(err error) bool {
+	if httpErr := httpStatusError(err); httpErr != nil {
+		code := httpErr.Response.StatusCode
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	if urlErr, ok := err.(*neturl.Error); ok {
+		err = urlErr.Err
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
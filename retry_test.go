@@ -0,0 +1,193 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+func TestLayerRetries(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		src := newFakeRegistry(t)
+		dest := newFakeRegistry(t)
+		src.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+
+		// Every kind of layer request fails once before it succeeds
+		var lock sync.Mutex
+		failed := map[string]bool{}
+		failOnce := func(r *fakeRegistry) func(w http.ResponseWriter, req *http.Request) bool {
+			return func(w http.ResponseWriter, req *http.Request) bool {
+				if !strings.Contains(req.URL.Path, "/blobs/") {
+					return false
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				// Uploads get a new location on every attempt
+				key := r.URL + req.Method + strings.SplitN(req.URL.Path, "/uploads/", 2)[0]
+				if failed[key] {
+					return false
+				}
+				failed[key] = true
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return true
+			}
+		}
+		src.Handler = failOnce(src)
+		dest.Handler = failOnce(dest)
+
+		options := testCopyOptions()
+		options.StreamLayers = stream
+		// A streamed layer is retried as a whole, for the download, the
+		// start of the upload and its end
+		options.LayerRetry = retryPolicy{Retries: 3}
+		_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+		if err != nil {
+			t.Fatalf("Expected the copy with streaming %v to succeed after retries, got %v", stream, err)
+		}
+		if _, ok := dest.Manifest("app", "1.0"); !ok {
+			t.Errorf("Expected the manifest to be pushed with streaming %v", stream)
+		}
+	}
+}
+
+func TestLayerRetriesGiveUp(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	src.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+
+	attempts := 0
+	src.Handler = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method != "GET" || !strings.Contains(req.URL.Path, "/blobs/") {
+			return false
+		}
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+
+	options := testCopyOptions()
+	options.LayerRetry = retryPolicy{Retries: 2}
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err == nil {
+		t.Fatal("Expected the copy to fail")
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts to download the layer, got %d", attempts)
+	}
+}
+
+func TestLayerNotFoundIsNotRetried(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	image := src.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+	src.lock.Lock()
+	for key := range src.blobs {
+		if strings.HasSuffix(key, digestOf(image.Layers[0])) {
+			delete(src.blobs, key)
+		}
+	}
+	src.lock.Unlock()
+
+	options := testCopyOptions()
+	options.LayerRetry = retryPolicy{Retries: 2}
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err == nil {
+		t.Fatal("Expected the copy to fail")
+	}
+	gets := 0
+	for _, request := range src.Requests() {
+		if strings.HasPrefix(request, "GET ") && strings.Contains(request, "/blobs/"+digestOf(image.Layers[0])) {
+			gets++
+		}
+	}
+	if gets != 1 {
+		t.Errorf("Expected a missing layer to be downloaded once, got %d attempts", gets)
+	}
+}
+
+func TestRetriesStopAtDeadline(t *testing.T) {
+	deadline, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	policy := retryPolicy{Retries: 5, Delay: time.Hour, Deadline: deadline}
+
+	attempts := 0
+	start := time.Now()
+	err := retryTransient("Downloading layer", policy, func() error {
+		attempts++
+		return io.ErrUnexpectedEOF
+	})
+	if err != io.ErrUnexpectedEOF || attempts != 1 {
+		t.Errorf("Expected the last error after a single attempt, got %v after %d attempt(s)", err, attempts)
+	}
+
+	err = retryOnManifestUnknown("app", "1.0", policy, func() error {
+		attempts++
+		return &registry.HttpStatusError{Response: &http.Response{StatusCode: http.StatusNotFound}}
+	})
+	if !isManifestUnknown(err) || attempts != 2 {
+		t.Errorf("Expected the manifest to stay unknown after a single attempt, got %v after %d attempt(s)", err, attempts-1)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected the retries to stop at the deadline, they took %v", elapsed)
+	}
+}
+
+func TestSegmentRetries(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	src.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+
+	// Every segment fails once before it succeeds
+	var lock sync.Mutex
+	failed := map[string]bool{}
+	ranges := 0
+	src.Handler = func(w http.ResponseWriter, req *http.Request) bool {
+		rangeHeader := req.Header.Get("Range")
+		if rangeHeader == "" {
+			return false
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		ranges++
+		key := req.URL.Path + " " + rangeHeader
+		if failed[key] {
+			return false
+		}
+		failed[key] = true
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	}
+
+	options := testCopyOptions()
+	options.MemoryThreshold = 0
+	options.DownloadSegments = 2
+	options.LayerRetry = retryPolicy{Retries: 1}
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err != nil {
+		t.Fatalf("Expected the segmented download to succeed after retries, got %v", err)
+	}
+	// The layer and the config, in 2 segments each
+	if len(failed) != 4 || ranges != 8 {
+		t.Errorf("Expected 4 segments to be requested twice each, got %d requests for %d segments", ranges, len(failed))
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// rewriteImageConfig replaces registry references in the config of an image,
+// like labels naming the registry the image was built for. It returns nil
+// for the config when nothing had to be replaced. Otherwise the config gets
+// a new digest, so it also returns the manifest rewritten to reference the
+// new config, which is no longer the byte for byte copy of the source.
+func rewriteImageConfig(srcHub *registry.Registry, srcRepo string, content []byte, config descriptor, replacements map[string]string) ([]byte, []byte, error) {
+	reader, err := srcHub.DownloadLayer(srcRepo, config.Digest)
+	if err != nil {
+		return content, nil, err
+	}
+	configContent, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return content, nil, err
+	}
+
+	var parsedConfig map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(configContent))
+	decoder.UseNumber()
+	err = decoder.Decode(&parsedConfig)
+	if err != nil {
+		return content, nil, err
+	}
+
+	replacer := referenceReplacer(replacements)
+	changed := false
+	for key, value := range parsedConfig {
+		// The layer digests can't name a registry
+		if key == "rootfs" {
+			continue
+		}
+		parsedConfig[key] = replaceReferences(value, replacer, &changed)
+	}
+	if !changed {
+		return content, nil, nil
+	}
+
+	newConfig, err := marshalJSON(parsedConfig)
+	if err != nil {
+		return content, nil, err
+	}
+
+	var parsedManifest map[string]interface{}
+	decoder = json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	err = decoder.Decode(&parsedManifest)
+	if err != nil {
+		return content, nil, err
+	}
+	configDescriptor, ok := parsedManifest["config"].(map[string]interface{})
+	if !ok {
+		return content, nil, nil
+	}
+	configDescriptor["digest"] = digest.FromBytes(newConfig).String()
+	configDescriptor["size"] = len(newConfig)
+
+	newContent, err := marshalJSON(parsedManifest)
+	if err != nil {
+		return content, nil, err
+	}
+	return newContent, newConfig, nil
+}
+
+// referenceReplacer replaces the longest matching reference first, so a
+// registry host wins over a shorter prefix of it.
+func referenceReplacer(replacements map[string]string) *strings.Replacer {
+	olds := make([]string, 0, len(replacements))
+	for old := range replacements {
+		olds = append(olds, old)
+	}
+	sort.Slice(olds, func(i, j int) bool { return len(olds[i]) > len(olds[j]) })
+
+	pairs := []string{}
+	for _, old := range olds {
+		pairs = append(pairs, old, replacements[old])
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// replaceReferences replaces the registry references in every string found in
+// a decoded JSON value.
+func replaceReferences(value interface{}, replacer *strings.Replacer, changed *bool) interface{} {
+	switch typed := value.(type) {
+	case string:
+		replaced := replacer.Replace(typed)
+		if replaced != typed {
+			*changed = true
+		}
+		return replaced
+	case map[string]interface{}:
+		for key, nested := range typed {
+			typed[key] = replaceReferences(nested, replacer, changed)
+		}
+		return typed
+	case []interface{}:
+		for i, nested := range typed {
+			typed[i] = replaceReferences(nested, replacer, changed)
+		}
+		return typed
+	}
+	return value
+}
+
+// marshalJSON encodes like json.Marshal but leaves characters like & and <
+// alone, which are common in the commands recorded in the image history.
+func marshalJSON(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buffer.Bytes(), "\n"), nil
+}
+
+// uploadBlob uploads content held in memory unless the destination already
+// has it, and tells whether it was uploaded.
+func uploadBlob(hub *registry.Registry, repository string, blobDigest digest.Digest, content []byte) (bool, error) {
+	exists, err := hub.HasLayer(repository, blobDigest)
+	if err != nil || exists {
+		return false, err
+	}
+	err = hub.UploadLayer(repository, blobDigest, bytes.NewReader(content))
+	return err == nil, err
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// addImageWithUnknownFields pushes an image whose manifest has fields this
+// tool doesn't know, at the top and in a layer.
+func addImageWithUnknownFields(t *testing.T, fake *fakeRegistry) {
+	image := fake.addTestImage(t, "app", "1.0", map[string]string{"base": "old.example.com/base"}, []string{"a"}, map[string]interface{}{
+		"x-build": map[string]interface{}{"pipeline": "nightly", "url": "https://ci.example.com/?a=1&b=2"},
+	})
+	var manifest map[string]interface{}
+	if err := json.Unmarshal(image.Manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	manifest["layers"].([]interface{})[0].(map[string]interface{})["compression"] = "gzip"
+	fake.AddManifest("app", "1.0", "application/vnd.docker.distribution.manifest.v2+json", jsonBytes(t, manifest))
+}
+
+func TestRewriteKeepsUnknownFields(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	addImageWithUnknownFields(t, src)
+	original, _ := src.Manifest("app", "1.0")
+
+	options := testCopyOptions()
+	options.RewriteRefs = map[string]string{"old.example.com": "new.example.com"}
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied, ok := dest.Manifest("app", "1.0")
+	if !ok {
+		t.Fatal("Expected the manifest to be pushed")
+	}
+	if string(copied.Content) == string(original.Content) {
+		t.Fatal("Expected the manifest to reference the rewritten config")
+	}
+	var before, after map[string]interface{}
+	if err := json.Unmarshal(original.Content, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(copied.Content, &after); err != nil {
+		t.Fatal(err)
+	}
+	if string(jsonBytes(t, after["x-build"])) != string(jsonBytes(t, before["x-build"])) {
+		t.Errorf("Expected x-build to survive the rewrite, got %v", after["x-build"])
+	}
+	if !strings.Contains(string(copied.Content), "https://ci.example.com/?a=1&b=2") {
+		t.Error("Expected the URL in x-build to be kept as it was, without escaping")
+	}
+	layer := after["layers"].([]interface{})[0].(map[string]interface{})
+	if layer["compression"] != "gzip" {
+		t.Errorf("Expected layers[0].compression to survive the rewrite, got %v", layer["compression"])
+	}
+}
+
+func TestStrictRefusesUnknownFields(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	addImageWithUnknownFields(t, src)
+
+	options := testCopyOptions()
+	options.RewriteRefs = map[string]string{"old.example.com": "new.example.com"}
+	options.Strict = true
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err == nil || !strings.Contains(err.Error(), "layers[0].compression") || !strings.Contains(err.Error(), "x-build") {
+		t.Fatalf("Expected --strict to refuse the unknown fields, got %v", err)
+	}
+	if _, ok := dest.Manifest("app", "1.0"); ok {
+		t.Error("Expected no manifest to be pushed")
+	}
+	if len(dest.Requests()) > 1 {
+		t.Errorf("Expected nothing but the ping to reach the destination, got %v", dest.Requests())
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// tempBudget bounds the bytes held in temp files at once, as set with
+// --max-temp-bytes. Every temp file reserves the size of what it is going to
+// hold before it is created. Layers are copied one after the other, so
+// nothing would ever free up the budget for a reservation that has to wait,
+// which therefore fails instead. A nil budget has no limit.
+type tempBudget struct {
+	Limit int64
+
+	lock sync.Mutex
+	used int64
+}
+
+func newTempBudget(limit int64) *tempBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &tempBudget{Limit: limit}
+}
+
+// Reserve takes size bytes of the budget, or fails when they are not free.
+func (b *tempBudget) Reserve(size int64) error {
+	if b == nil || size <= 0 {
+		return nil
+	}
+	if size > b.Limit {
+		return fmt.Errorf("%s of temp space are needed but --max-temp-bytes only allows %s", formatBytes(size), formatBytes(b.Limit))
+	}
+	if !b.TryReserve(size) {
+		return fmt.Errorf("%s of temp space are needed but only %s of the %s allowed by --max-temp-bytes are free", formatBytes(size), formatBytes(b.free()), formatBytes(b.Limit))
+	}
+	return nil
+}
+
+func (b *tempBudget) free() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.Limit - b.used
+}
+
+// TryReserve takes size bytes of the budget if they are free right now.
+func (b *tempBudget) TryReserve(size int64) bool {
+	if b == nil || size <= 0 {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.used+size > b.Limit {
+		return false
+	}
+	b.used += size
+	return true
+}
+
+func (b *tempBudget) Release(size int64) {
+	if b == nil || size <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.used -= size
+}
+
+// tempReservation is the part of the budget held by one temp file.
+type tempReservation struct {
+	budget *tempBudget
+	size   int64
+}
+
+// Writer accounts for what is written to a temp file. Writing more than was
+// reserved takes more of the budget, or fails when it is used up.
+func (r *tempReservation) Writer(writer io.Writer) io.Writer {
+	return &reservedWriter{Writer: writer, reservation: r}
+}
+
+type reservedWriter struct {
+	io.Writer
+	reservation *tempReservation
+	written     int64
+}
+
+func (w *reservedWriter) Write(p []byte) (int, error) {
+	r := w.reservation
+	if extra := w.written + int64(len(p)) - r.size; extra > 0 {
+		if !r.budget.TryReserve(extra) {
+			return 0, fmt.Errorf("The temp files would take more than the %s allowed by --max-temp-bytes", formatBytes(r.budget.Limit))
+		}
+		r.size += extra
+	}
+	n, err := w.Writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTempBudgetFailsWithoutSpace(t *testing.T) {
+	budget := newTempBudget(100)
+	if err := budget.Reserve(60); err != nil {
+		t.Fatal(err)
+	}
+	if err := budget.Reserve(60); err == nil {
+		t.Error("Expected a reservation beyond the free budget to fail rather than wait")
+	}
+
+	budget.Release(60)
+	if err := budget.Reserve(60); err != nil {
+		t.Errorf("Expected the reservation to go through once the first was released, got %v", err)
+	}
+	if err := budget.Reserve(101); err == nil {
+		t.Error("Expected a reservation larger than the whole budget to fail")
+	}
+}
+
+func TestTempReservationGrows(t *testing.T) {
+	budget := newTempBudget(100)
+	reservation := &tempReservation{budget: budget, size: 40}
+	if err := budget.Reserve(40); err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	writer := reservation.Writer(&buffer)
+	if _, err := writer.Write(make([]byte, 90)); err != nil {
+		t.Fatalf("Expected the reservation to grow within the budget, got %v", err)
+	}
+	if reservation.size != 90 {
+		t.Errorf("Expected 90 bytes to be reserved, got %d", reservation.size)
+	}
+	if _, err := writer.Write(make([]byte, 20)); err == nil {
+		t.Error("Expected writing beyond the budget to fail")
+	}
+	if budget.TryReserve(11) {
+		t.Error("Expected the budget to be used up but for 10 bytes")
+	}
+}
+
+func TestRecompressWithinTempBudget(t *testing.T) {
+	src := newFakeRegistry(t)
+	dest := newFakeRegistry(t)
+	image := src.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+
+	// Decompressing the layer takes more space than the gzip layer
+	options := testCopyOptions()
+	options.Recompress = recompressionUncompressed
+	options.MaxTempBytes = int64(len(image.Layers[0]))
+	options.TempBudget = newTempBudget(options.MaxTempBytes)
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err == nil {
+		t.Fatal("Expected the decompressed layer not to fit in the temp budget")
+	}
+
+	options.MaxTempBytes = 1024 * 1024
+	options.TempBudget = newTempBudget(options.MaxTempBytes)
+	_, err = copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "app", "1.0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget := options.TempBudget; budget.used != 0 {
+		t.Errorf("Expected every reservation to be released, %d bytes are still reserved", budget.used)
+	}
+}
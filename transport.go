@@ -0,0 +1,264 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headerTransport adds a User-Agent and any extra headers to every request
+// sent to a registry, including the token requests of the auth flow.
+type headerTransport struct {
+	Transport http.RoundTripper
+	UserAgent string
+	Headers   map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the caller's request, so work on a copy
+	headerReq := new(http.Request)
+	*headerReq = *req
+	headerReq.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		headerReq.Header[name] = append([]string(nil), values...)
+	}
+
+	if t.UserAgent != "" {
+		headerReq.Header.Set("User-Agent", t.UserAgent)
+	}
+	for name, value := range t.Headers {
+		headerReq.Header.Set(name, value)
+	}
+
+	return t.Transport.RoundTrip(headerReq)
+}
+
+// limitTransport bounds how many requests to a registry are in flight at
+// once. The source and the destination each have their own limit, also when
+// they are the same registry, since a layer streamed between them holds a
+// request on both sides at once. A successful GET holds its slot until the
+// body is closed, as the download is still running until then. Every other
+// request is done when the response arrives: uploads have been sent by then
+// and error bodies are small. Releasing those early also matters because the
+// auth flow sends the token request before closing the challenge response,
+// and the registry client never closes the response of a blob upload.
+type limitTransport struct {
+	Transport http.RoundTripper
+	Semaphore chan struct{}
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.Semaphore <- struct{}{}
+	release := func() { <-t.Semaphore }
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil || req.Method != "GET" || resp.StatusCode >= 300 {
+		release()
+		return resp, err
+	}
+
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// locationTransport turns a relative Location header into an absolute URL.
+// Registries behind a path prefix, like Artifactory, tend to answer with
+// relative upload locations, which the registry client would otherwise
+// send requests to as they are.
+type locationTransport struct {
+	Transport http.RoundTripper
+}
+
+func (t *locationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if location := resp.Header.Get("Location"); location != "" {
+		locationURL, err := req.URL.Parse(location)
+		if err == nil {
+			resp.Header.Set("Location", locationURL.String())
+		}
+	}
+	return resp, nil
+}
+
+// deadlineTransport sends every request with the context of the whole run,
+// so all requests to both registries are aborted once --deadline passed,
+// including the transfer of a response body that is still being read. The
+// dir:// and oci:// transports never look at the context, so the deadline is
+// checked here as well, before every request and every read of a body.
+type deadlineTransport struct {
+	Transport http.RoundTripper
+	Context   context.Context
+}
+
+func (t *deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.Context.Err(); err != nil {
+		return nil, err
+	}
+	resp, err := t.Transport.RoundTrip(req.WithContext(t.Context))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &deadlineBody{ReadCloser: resp.Body, Context: t.Context}
+	return resp, nil
+}
+
+type deadlineBody struct {
+	io.ReadCloser
+	Context context.Context
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	if err := b.Context.Err(); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// debugTransport logs every request sent to a registry and the response to
+// it, with credentials redacted. It sits below the auth transports so the
+// token requests and the authorization they add are visible as well. The
+// values of the headers added with --header are redacted too, as they often
+// carry API keys.
+type debugTransport struct {
+	Transport http.RoundTripper
+	Headers   map[string]string
+}
+
+// redactedHeaders carry credentials and are never logged.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// isRedactedHeader tells whether the value of a header may be a credential:
+// a well known one, any added with --header or one named like a key, token
+// or secret.
+func isRedactedHeader(name string, custom map[string]string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if redactedHeaders[name] {
+		return true
+	}
+	for customName := range custom {
+		if http.CanonicalHeaderKey(customName) == name {
+			return true
+		}
+	}
+	lower := strings.ToLower(name)
+	return strings.Contains(lower, "key") || strings.Contains(lower, "token") || strings.Contains(lower, "secret")
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	log.Printf("--> %s %s\n%s", req.Method, req.URL, formatHeaders(req.Header, t.Headers))
+
+	start := time.Now()
+	resp, err := t.Transport.RoundTrip(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		log.Printf("<-- %s %s failed after %v. %v", req.Method, req.URL, elapsed, err)
+		return resp, err
+	}
+
+	log.Printf("<-- %s %s %s in %v\n%s", resp.Status, req.Method, req.URL, elapsed, formatHeaders(resp.Header, t.Headers))
+	return resp, nil
+}
+
+func formatHeaders(header http.Header, custom map[string]string) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	for _, name := range names {
+		for _, value := range header[name] {
+			if isRedactedHeader(name, custom) {
+				value = redactHeaderValue(name, value)
+			}
+			lines = append(lines, "    "+name+": "+value)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// redactHeaderValue keeps the scheme of an Authorization header, which tells
+// basic and bearer auth apart, and drops the credentials.
+func redactHeaderValue(name string, value string) string {
+	if i := strings.Index(value, " "); i > 0 && strings.HasSuffix(http.CanonicalHeaderKey(name), "Authorization") {
+		return value[:i] + " [redacted]"
+	}
+	return "[redacted]"
+}
+
+// clientTLSConfig loads the client certificate a registry protected by mutual
+// TLS asks for. The key may be in the certificate file too. It returns nil
+// when no certificate was given.
+func clientTLSConfig(args RepositoryArguments) (*tls.Config, error) {
+	if *args.ClientCert == "" {
+		if *args.ClientKey != "" {
+			return nil, fmt.Errorf("--%s-client-key needs --%s-client-cert", args.Prefix, args.Prefix)
+		}
+		return nil, nil
+	}
+
+	keyFile := *args.ClientKey
+	if keyFile == "" {
+		keyFile = *args.ClientCert
+	}
+	cert, err := tls.LoadX509KeyPair(*args.ClientCert, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the client certificate %s for the %s registry. %v", *args.ClientCert, args.Description, err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// baseTransport is the transport the requests to a registry are sent with
+// before any of the wrapping transports above.
+func baseTransport(args RepositoryArguments) (http.RoundTripper, error) {
+	tlsConfig, err := clientTLSConfig(args)
+	if err != nil || tlsConfig == nil {
+		return http.DefaultTransport, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestOneConnectionToTheSameRegistry(t *testing.T) {
+	fake := newFakeRegistry(t)
+	fake.addTestImage(t, "team/app", "1.0", nil, []string{"a", "b"}, nil)
+
+	connect := func(prefix string, repository string) RepositoryArguments {
+		args := testArguments(prefix, fake.URL, repository, "1.0")
+		*args.MaxConns = 1
+		return args
+	}
+	srcHub, err := connectToRegistry(connect("src", "team/app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	destHub, err := connectToRegistry(connect("dest", "mirror/app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stream := range []bool{true, false} {
+		destRepo := fmt.Sprintf("mirror/app-%v", stream)
+		options := testCopyOptions()
+		options.MountLayers = false
+		options.StreamLayers = stream
+		options.MemoryThreshold = 0
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := copyImage(srcHub, destHub, "team/app", "1.0", destRepo, "1.0", options)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("The copy with streaming %v did not finish, the connection limit deadlocked", stream)
+		}
+		if _, ok := fake.Manifest(destRepo, "1.0"); !ok {
+			t.Errorf("Expected the manifest to be pushed to %s", destRepo)
+		}
+	}
+}
+
+func TestRegistryBehindPathPrefix(t *testing.T) {
+	const prefix = "/artifactory/api/docker/x"
+	for _, absolute := range []bool{false, true} {
+		src := newFakeRegistry(t)
+		src.Prefix = prefix
+		dest := newFakeRegistry(t)
+		dest.Prefix = prefix
+		dest.AbsoluteLocation = absolute
+		src.addTestImage(t, "team/app", "1.0", nil, []string{"a", "b"}, nil)
+
+		_, err := copyImage(src.Hub(t), dest.Hub(t), "team/app", "1.0", "team/app", "1.0", testCopyOptions())
+		if err != nil {
+			t.Fatalf("Expected the copy with absolute locations %v to succeed, got %v", absolute, err)
+		}
+		if _, ok := dest.Manifest("team/app", "1.0"); !ok {
+			t.Errorf("Expected the manifest to be pushed with absolute locations %v", absolute)
+		}
+
+		for _, fake := range []*fakeRegistry{src, dest} {
+			for _, request := range fake.Requests() {
+				path := strings.SplitN(request, " ", 2)[1]
+				if !strings.HasPrefix(path, prefix+"/v2/") {
+					t.Errorf("Expected every request to stay under %s, got %s", prefix, request)
+				}
+			}
+		}
+	}
+}
+
+func TestLocalTransportsStopAtDeadline(t *testing.T) {
+	for _, prefix := range []string{dirTransportPrefix, ociTransportPrefix} {
+		src := newFakeRegistry(t)
+		src.addTestImage(t, "app", "1.0", nil, []string{"a"}, nil)
+
+		deadline, cancel := context.WithCancel(context.Background())
+		args := testArguments("dest", prefix+t.TempDir(), "app", "1.0")
+		args.Deadline = deadline
+		destHub, err := connectToRegistry(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = copyImage(src.Hub(t), destHub, "app", "1.0", "app", "1.0", testCopyOptions())
+		if err != nil {
+			t.Fatalf("Expected the copy to %s to succeed before the deadline, got %v", prefix, err)
+		}
+
+		cancel()
+		_, err = copyImage(src.Hub(t), destHub, "app", "1.0", "app", "1.1", testCopyOptions())
+		if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+			t.Errorf("Expected the copy to %s to stop once the deadline passed, got %v", prefix, err)
+		}
+	}
+}
+
+func TestLayoutsKeepBlobOnBadUpload(t *testing.T) {
+	dirPath, layoutPath := t.TempDir(), t.TempDir()
+	directory := &dirTransport{URL: dirTransportPrefix + dirPath, Path: dirPath}
+	layout := &ociLayoutTransport{URL: ociTransportPrefix + layoutPath, Path: layoutPath}
+	testKeepsBlobOnBadUpload(t, directory.URL, directory.upload, func(blobDigest digest.Digest) string {
+		return filepath.Join(dirPath, blobDigest.Hex())
+	})
+	testKeepsBlobOnBadUpload(t, layout.URL, layout.upload, layout.blobPath)
+}
+
+func testKeepsBlobOnBadUpload(t *testing.T, url string, upload func(*http.Request, string, string) (*http.Response, error), blobPath func(digest.Digest) string) {
+	blob := []byte("good blob")
+	blobDigest := digest.FromBytes(blob)
+
+	uploads := []struct {
+		content []byte
+		status  int
+	}{
+		{blob, http.StatusCreated},
+		{[]byte("truncated"), http.StatusBadRequest},
+	}
+	for _, test := range uploads {
+		req := httptest.NewRequest("PUT", url+"/v2/app/blobs/uploads/1?digest="+blobDigest.String(), bytes.NewReader(test.content))
+		resp, err := upload(req, "/v2/app", "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("Expected the upload of %q to %s to answer %d, got %d", test.content, url, test.status, resp.StatusCode)
+		}
+	}
+
+	stored, err := ioutil.ReadFile(blobPath(blobDigest))
+	if err != nil || !bytes.Equal(stored, blob) {
+		t.Errorf("Expected the good blob in %s to survive the bad upload, got %q, %v", url, stored, err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(blobPath(blobDigest)))
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			t.Errorf("Expected no temp file to be left behind, got %s", file.Name())
+		}
+	}
+}
+
+func TestDebugLogRedactsCustomHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret-token")
+	header.Set("X-JFrog-Art-Api", "artifactory-key")
+	header.Set("X-Api-Key", "api-key")
+	header.Set("X-Team", "platform")
+	header.Set("Docker-Content-Digest", "sha256:abc")
+
+	formatted := formatHeaders(header, map[string]string{"x-team": "platform", "x-jfrog-art-api": "artifactory-key"})
+	for _, secret := range []string{"secret-token", "artifactory-key", "api-key", "platform"} {
+		if strings.Contains(formatted, secret) {
+			t.Errorf("Expected %s to be redacted, got\n%s", secret, formatted)
+		}
+	}
+	for _, line := range []string{"Authorization: Bearer [redacted]", "Docker-Content-Digest: sha256:abc"} {
+		if !strings.Contains(formatted, line) {
+			t.Errorf("Expected %s to be logged, got\n%s", line, formatted)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// verifyPull reads a copied image back from the destination the way a pull
+// would: the manifest must be the one that was pushed, and every blob it
+// references must be readable with its recorded size. Registries that are
+// only eventually consistent can acknowledge a push before that holds.
+// Every problem found is reported, not just the first one.
+func verifyPull(hub *registry.Registry, repository string, reference string, mediaType string, pushed []byte) error {
+	fmt.Printf("Verifying %s:%s can be pulled from the destination\n", repository, reference)
+
+	problems := verifyManifest(hub, repository, reference, manifestDigest(pushed, mediaType))
+	if len(problems) > 0 {
+		return &exitError{Code: exitTransfer, Err: fmt.Errorf("The copy of %s:%s did not verify:\n  %s", repository, reference, strings.Join(problems, "\n  "))}
+	}
+
+	fmt.Println("Verified the copy in the destination")
+	return nil
+}
+
+func verifyManifest(hub *registry.Registry, repository string, reference string, expected digest.Digest) []string {
+	mediaTypes := append(append(append([]string{}, indexMediaTypes...), imageManifestMediaTypes...), ociArtifactManifestMediaType)
+	content, mediaType, err := getManifest(hub, repository, reference, mediaTypes)
+	if err != nil {
+		return []string{fmt.Sprintf("manifest %s: %v", reference, err)}
+	}
+
+	// The registry may sign a schema1 manifest it receives, which leaves
+	// the payload as it was pushed, so the payloads are compared
+	actual := manifestDigest(content, mediaType)
+	if actual != expected {
+		return []string{fmt.Sprintf("manifest %s: the destination has %s instead of %s", reference, actual, expected)}
+	}
+
+	manifest, err := parseRawManifest(content)
+	if err != nil {
+		return []string{fmt.Sprintf("manifest %s: %v", reference, err)}
+	}
+
+	problems := []string{}
+	for _, blob := range manifest.BlobDescriptors() {
+		metadata, err := hub.LayerMetadata(repository, blob.Digest)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("blob %s: %v", blob.Digest, err))
+		} else if blob.Size > 0 && metadata.Size >= 0 && metadata.Size != blob.Size {
+			problems = append(problems, fmt.Sprintf("blob %s: the destination has %d bytes instead of %d", blob.Digest, metadata.Size, blob.Size))
+		}
+	}
+
+	for _, entry := range manifest.Manifests {
+		problems = append(problems, verifyManifest(hub, repository, entry.Digest.String(), entry.Digest)...)
+	}
+	return problems
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2017 Matt Lavin <matt.lavin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/libtrust"
+)
+
+// signingRegistry starts a registry that signs the unsigned schema1
+// manifests pushed to it, keeping their payload.
+func signingRegistry(t *testing.T) *fakeRegistry {
+	fake := newFakeRegistry(t)
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Handler = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method != "PUT" || req.Header.Get("Content-Type") != schema1.MediaTypeManifest {
+			return false
+		}
+		content, _ := ioutil.ReadAll(req.Body)
+		signature, err := libtrust.NewJSONSignature(content)
+		if err == nil {
+			err = signature.Sign(key)
+		}
+		var signed []byte
+		if err == nil {
+			signed, err = signature.PrettySignature("signatures")
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return true
+		}
+		path := strings.TrimPrefix(req.URL.Path, "/v2/")
+		i := strings.LastIndex(path, "/manifests/")
+		fake.AddManifest(path[:i], path[i+len("/manifests/"):], schema1.MediaTypeSignedManifest, signed)
+		w.WriteHeader(http.StatusCreated)
+		return true
+	}
+	return fake
+}
+
+func TestVerifySignedSchema1(t *testing.T) {
+	src := newFakeRegistry(t)
+	src.addSchema1Image(t, "app", "1.0", []string{"a", "b"})
+	dest := signingRegistry(t)
+
+	options := testCopyOptions()
+	options.VerifyPull = true
+	_, err := copyImage(src.Hub(t), dest.Hub(t), "app", "1.0", "mirror/app", "1.0", options)
+	if err != nil {
+		t.Fatalf("Expected the signed copy to verify, got %v", err)
+	}
+
+	// A different image behind the tag doesn't verify, even though its
+	// layers are all there
+	pushed, ok := dest.Manifest("mirror/app", "1.0")
+	if !ok {
+		t.Fatal("Expected the manifest to be pushed")
+	}
+	var signed schema1.SignedManifest
+	if err := signed.UnmarshalJSON(pushed.Content); err != nil {
+		t.Fatal(err)
+	}
+	src.addSchema1Image(t, "app", "2.0", []string{"a"})
+	other, _ := src.Manifest("app", "2.0")
+	dest.AddManifest("mirror/app", "1.0", schema1.MediaTypeSignedManifest, other.Content)
+
+	err = verifyPull(dest.Hub(t), "mirror/app", "1.0", schema1.MediaTypeManifest, signed.Canonical)
+	if err == nil || !strings.Contains(err.Error(), "instead of") {
+		t.Errorf("Expected a different manifest to fail the verification, got %v", err)
+	}
+}